@@ -0,0 +1,299 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"libvirt.org/go/libvirt"
+)
+
+// Collector is a group of metrics that can be enabled or disabled with
+// --collector.<name> and --no-collector.<name> flags.
+type Collector struct {
+	Name           string
+	DefaultEnabled bool
+	Descs          []*prometheus.Desc
+	// StatsTypes are the stats requested from GetAllDomainStats for the
+	// collector.
+	StatsTypes libvirt.DomainStatsTypes
+	// CollectDomain reports metrics of a single domain, if set.
+	CollectDomain func(ch chan<- prometheus.Metric, domain *DomainContext) error
+	// CollectConnection reports metrics not bound to a domain, if set.
+	CollectConnection func(ch chan<- prometheus.Metric, conn *libvirt.Connect, scrapeStats *ScrapeStats) error
+}
+
+// collectors lists all available collectors in the order they are run.
+var collectors = []*Collector{
+	{
+		Name:           "domain_info",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainInfoMetaDesc,
+			libvirtDomainInfoMaxMemBytesDesc,
+			libvirtDomainInfoMemoryUsageBytesDesc,
+			libvirtDomainInfoNrVirtCPUDesc,
+			libvirtDomainInfoCPUTimeDesc,
+			libvirtDomainInfoVirDomainState,
+			libvirtDomainStateReasonDesc,
+		},
+		CollectDomain: collectDomainInfo,
+	},
+	{
+		Name:           "cpu",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainCPUUserDesc,
+			libvirtDomainCPUSystemDesc,
+			libvirtDomainCPUUtilisationDesc,
+		},
+		StatsTypes:    libvirt.DOMAIN_STATS_CPU_TOTAL,
+		CollectDomain: collectDomainCPU,
+	},
+	{
+		Name:           "vcpu",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainVcpuStateDesc,
+			libvirtDomainVcpuTimeDesc,
+			libvirtDomainVcpuDelayDesc,
+			libvirtDomainVcpuCPUDesc,
+			libvirtDomainVcpuWaitDesc,
+		},
+		StatsTypes:    libvirt.DOMAIN_STATS_VCPU,
+		CollectDomain: collectDomainVcpu,
+	},
+	{
+		Name:           "pinning",
+		DefaultEnabled: false,
+		Descs: []*prometheus.Desc{
+			libvirtDomainVcpuPinningInfoDesc,
+			libvirtDomainEmulatorPinningInfoDesc,
+			libvirtHostCPUPinnedVcpusDesc,
+		},
+		CollectDomain:     collectDomainPinning,
+		CollectConnection: collectHostCPUPinning,
+	},
+	{
+		Name:           "iothread",
+		DefaultEnabled: false,
+		Descs: []*prometheus.Desc{
+			libvirtDomainIOThreadPinningInfoDesc,
+		},
+		CollectDomain: collectDomainIOThreads,
+	},
+	{
+		Name:           "scheduler",
+		DefaultEnabled: false,
+		Descs: []*prometheus.Desc{
+			libvirtDomainSchedulerCPUSharesDesc,
+			libvirtDomainSchedulerGlobalPeriodDesc,
+			libvirtDomainSchedulerGlobalQuotaDesc,
+			libvirtDomainSchedulerVcpuPeriodDesc,
+			libvirtDomainSchedulerVcpuQuotaDesc,
+			libvirtDomainSchedulerEmulatorPeriodDesc,
+			libvirtDomainSchedulerEmulatorQuotaDesc,
+			libvirtDomainSchedulerIOThreadPeriodDesc,
+			libvirtDomainSchedulerIOThreadQuotaDesc,
+		},
+		CollectDomain: collectDomainScheduler,
+	},
+	{
+		Name:           "block",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainMetaBlockDesc,
+			libvirtDomainBlockMediaInsertedDesc,
+			libvirtDomainBlockTrayOpenDesc,
+			libvirtDomainBlockRdBytesDesc,
+			libvirtDomainBlockRdReqDesc,
+			libvirtDomainBlockRdTotalTimeSecondsDesc,
+			libvirtDomainBlockWrBytesDesc,
+			libvirtDomainBlockWrReqDesc,
+			libvirtDomainBlockWrTotalTimesDesc,
+			libvirtDomainBlockFlushReqDesc,
+			libvirtDomainBlockFlushTotalTimeSecondsDesc,
+			libvirtDomainBlockAllocationDesc,
+			libvirtDomainBlockCapacityBytesDesc,
+			libvirtDomainBlockPhysicalSizeBytesDesc,
+		},
+		StatsTypes:    libvirt.DOMAIN_STATS_BLOCK,
+		CollectDomain: collectDomainBlock,
+	},
+	{
+		Name:           "blkiotune",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainBlockTotalBytesSecDesc,
+			libvirtDomainBlockWriteBytesSecDesc,
+			libvirtDomainBlockReadBytesSecDesc,
+			libvirtDomainBlockTotalIopsSecDesc,
+			libvirtDomainBlockWriteIopsSecDesc,
+			libvirtDomainBlockReadIopsSecDesc,
+			libvirtDomainBlockTotalBytesSecMaxDesc,
+			libvirtDomainBlockWriteBytesSecMaxDesc,
+			libvirtDomainBlockReadBytesSecMaxDesc,
+			libvirtDomainBlockTotalIopsSecMaxDesc,
+			libvirtDomainBlockWriteIopsSecMaxDesc,
+			libvirtDomainBlockReadIopsSecMaxDesc,
+			libvirtDomainBlockTotalBytesSecMaxLengthDesc,
+			libvirtDomainBlockWriteBytesSecMaxLengthDesc,
+			libvirtDomainBlockReadBytesSecMaxLengthDesc,
+			libvirtDomainBlockTotalIopsSecMaxLengthDesc,
+			libvirtDomainBlockWriteIopsSecMaxLengthDesc,
+			libvirtDomainBlockReadIopsSecMaxLengthDesc,
+			libvirtDomainBlockSizeIopsSecDesc,
+		},
+		// Block stats are needed for the list of disks
+		StatsTypes:    libvirt.DOMAIN_STATS_BLOCK,
+		CollectDomain: collectDomainBlkioTune,
+	},
+	{
+		Name:           "interface",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainMetaInterfacesDesc,
+			libvirtDomainInterfaceRxBytesDesc,
+			libvirtDomainInterfaceRxPacketsDesc,
+			libvirtDomainInterfaceRxErrsDesc,
+			libvirtDomainInterfaceRxDropDesc,
+			libvirtDomainInterfaceTxBytesDesc,
+			libvirtDomainInterfaceTxPacketsDesc,
+			libvirtDomainInterfaceTxErrsDesc,
+			libvirtDomainInterfaceTxDropDesc,
+		},
+		StatsTypes:    libvirt.DOMAIN_STATS_INTERFACE,
+		CollectDomain: collectDomainInterface,
+	},
+	{
+		Name:           "memory",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainMemoryStatAvailableDesc,
+			libvirtDomainMemoryStatPeriodDesc,
+			libvirtDomainMemoryStatPeriodChangePendingDesc,
+			libvirtDomainMemoryStatMajorFaultTotalDesc,
+			libvirtDomainMemoryStatMinorFaultTotalDesc,
+			libvirtDomainMemoryStatUnusedBytesDesc,
+			libvirtDomainMemoryStatAvailableBytesDesc,
+			libvirtDomainMemoryStatActualBaloonBytesDesc,
+			libvirtDomainMemoryStatRssBytesDesc,
+			libvirtDomainMemoryStatUsableBytesDesc,
+			libvirtDomainMemoryStatDiskCachesBytesDesc,
+			libvirtDomainMemoryStatUsedPercentDesc,
+			libvirtDomainMemoryStatMaximumBytesDesc,
+			libvirtDomainMemoryStatSwapInBytesDesc,
+			libvirtDomainMemoryStatSwapOutBytesDesc,
+			libvirtDomainMemoryStatLastUpdateDesc,
+			libvirtDomainMemoryStatHugetlbPgAllocDesc,
+			libvirtDomainMemoryStatHugetlbPgFailDesc,
+		},
+		StatsTypes:    libvirt.DOMAIN_STATS_BALLOON,
+		CollectDomain: collectDomainMemory,
+	},
+	{
+		Name:           "memtune",
+		DefaultEnabled: false,
+		Descs: []*prometheus.Desc{
+			libvirtDomainMemtuneHardLimitDesc,
+			libvirtDomainMemtuneSoftLimitDesc,
+			libvirtDomainMemtuneSwapHardLimitDesc,
+			libvirtDomainMemtuneMinGuaranteeDesc,
+		},
+		CollectDomain: collectDomainMemtune,
+	},
+	{
+		Name:           "perf",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtDomainPerfCmtDesc,
+			libvirtDomainPerfMbmtDesc,
+			libvirtDomainPerfMbmlDesc,
+			libvirtDomainPerfCacheMissesDesc,
+			libvirtDomainPerfCacheReferencesDesc,
+			libvirtDomainPerfInstructionsDesc,
+			libvirtDomainPerfCPUCyclesDesc,
+			libvirtDomainPerfBranchInstructionsDesc,
+			libvirtDomainPerfBranchMissesDesc,
+			libvirtDomainPerfBusCyclesDesc,
+			libvirtDomainPerfStalledCyclesFrontendDesc,
+			libvirtDomainPerfStalledCyclesBackendDesc,
+			libvirtDomainPerfRefCPUCyclesDesc,
+			libvirtDomainPerfCPUClockDesc,
+			libvirtDomainPerfTaskClockDesc,
+			libvirtDomainPerfPageFaultsDesc,
+			libvirtDomainPerfContextSwitchesDesc,
+			libvirtDomainPerfCPUMigrationsDesc,
+			libvirtDomainPerfPageFaultsMinDesc,
+			libvirtDomainPerfPageFaultsMajDesc,
+			libvirtDomainPerfAlignmentFaultsDesc,
+			libvirtDomainPerfEmulationFaultsDesc,
+		},
+		StatsTypes:    libvirt.DOMAIN_STATS_PERF,
+		CollectDomain: collectDomainPerf,
+	},
+	{
+		Name:           "pool",
+		DefaultEnabled: true,
+		Descs: []*prometheus.Desc{
+			libvirtPoolInfoCapacity,
+			libvirtPoolInfoAllocation,
+			libvirtPoolInfoAvailable,
+		},
+		CollectConnection: collectStoragePools,
+	},
+}
+
+// LookupCollectors returns the collectors with the given names.
+func LookupCollectors(names []string) ([]*Collector, error) {
+	var result []*Collector
+	for _, name := range names {
+		var found *Collector
+		for _, collector := range collectors {
+			if collector.Name == name {
+				found = collector
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		result = append(result, found)
+	}
+	return result, nil
+}
+
+// CollectorFlags registers --collector.<name> flags for all collectors.
+// The returned function maps collector names to whether they are enabled
+// once the flags are parsed.
+func CollectorFlags(app *kingpin.Application) func() map[string]bool {
+	enabled := make([]*bool, len(collectors))
+	for i, collector := range collectors {
+		defaultValue := "false"
+		if collector.DefaultEnabled {
+			defaultValue = "true"
+		}
+		enabled[i] = app.Flag("collector."+collector.Name,
+			fmt.Sprintf("Enable the %s collector (default: %s).", collector.Name, defaultValue)).
+			Default(defaultValue).Bool()
+	}
+	return func() map[string]bool {
+		result := make(map[string]bool)
+		for i, collector := range collectors {
+			result[collector.Name] = *enabled[i]
+		}
+		return result
+	}
+}
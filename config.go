@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// ConnectionConfig describes a libvirt URI to collect metrics from.
+type ConnectionConfig struct {
+	// Name is the value of the connection label, the URI by default.
+	Name string `yaml:"name"`
+	URI  string `yaml:"uri"`
+}
+
+// Config is the exporter configuration. Settings missing from the
+// configuration file keep the values set by command line arguments.
+type Config struct {
+	// ConnectionLabel is the label telling metrics of different
+	// connections apart. It is added if there are several connections.
+	ConnectionLabel string             `yaml:"connection_label"`
+	Connections     []ConnectionConfig `yaml:"connections"`
+	// Collectors maps collector names to whether they are enabled.
+	Collectors   map[string]bool    `yaml:"collectors"`
+	DomainFilter DomainFilterConfig `yaml:"domain_filter"`
+	// DomainLabels are names of the identity labels attached to domain
+	// metrics: name, uuid, nova_instance_name, nova_project_uuid or title.
+	DomainLabels []string           `yaml:"domain_labels"`
+	CustomLabels CustomLabelsConfig `yaml:"custom_labels"`
+	// BlockDeviceTypes are the types of block devices whose stats are
+	// exported: disk, cdrom, floppy or lun.
+	BlockDeviceTypes  []string                `yaml:"block_device_types"`
+	MemoryStatsPeriod MemoryStatsPeriodConfig `yaml:"memory_stats_period"`
+	// CPUUtilisation enables libvirt_domain_cpu_utilisation_ratio.
+	CPUUtilisation bool        `yaml:"cpu_utilisation"`
+	Probe          ProbeConfig `yaml:"probe"`
+}
+
+// LoadConfig reads the configuration file over base and validates the
+// result. If filename is empty, base is validated only.
+func LoadConfig(filename string, base Config) (*Config, error) {
+	cfg := base
+	cfg.Connections = append([]ConnectionConfig(nil), base.Connections...)
+	cfg.Collectors = make(map[string]bool)
+	for name, enabled := range base.Collectors {
+		cfg.Collectors[name] = enabled
+	}
+	cfg.Probe.AllowedTargets = append([]string(nil), base.Probe.AllowedTargets...)
+	cfg.Probe.Modules = make(map[string]ProbeModule)
+	for name, module := range base.Probe.Modules {
+		cfg.Probe.Modules[name] = module
+	}
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", filename, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	if !model.LabelName(c.ConnectionLabel).IsValid() {
+		return fmt.Errorf("invalid connection label %q", c.ConnectionLabel)
+	}
+	if len(c.Connections) == 0 {
+		return fmt.Errorf("no connections configured")
+	}
+	names := make(map[string]struct{})
+	for i := range c.Connections {
+		conn := &c.Connections[i]
+		if conn.URI == "" {
+			return fmt.Errorf("connection %d: uri is missing", i)
+		}
+		if conn.Name == "" {
+			conn.Name = conn.URI
+		}
+		if _, ok := names[conn.Name]; ok {
+			return fmt.Errorf("duplicate connection %q", conn.Name)
+		}
+		names[conn.Name] = struct{}{}
+	}
+	for name := range c.Collectors {
+		if _, err := LookupCollectors([]string{name}); err != nil {
+			return err
+		}
+	}
+	if _, err := NewDomainFilter(c.DomainFilter); err != nil {
+		return fmt.Errorf("domain filter: %s", err)
+	}
+	labels, err := NewLabelPolicy(c.DomainLabels)
+	if err != nil {
+		return err
+	}
+	customLabels, err := NewCustomLabels(c.CustomLabels, labels)
+	if err != nil {
+		return err
+	}
+	for _, rule := range c.CustomLabels.Labels {
+		if rule.Name == c.ConnectionLabel {
+			return fmt.Errorf("custom label %q conflicts with the connection label", rule.Name)
+		}
+	}
+	if err := checkConnectionLabel(c.ConnectionLabel, &DomainPolicy{Labels: labels, CustomLabels: customLabels}); err != nil {
+		return err
+	}
+	if _, err := BlockDeviceTypes(c.BlockDeviceTypes); err != nil {
+		return err
+	}
+	if err := c.MemoryStatsPeriod.validate(); err != nil {
+		return err
+	}
+	for name, module := range c.Probe.Modules {
+		if name == "" {
+			return fmt.Errorf("probe module without a name")
+		}
+		if _, err := LookupCollectors(module.Collectors); err != nil {
+			return fmt.Errorf("probe module %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// EnabledCollectors lists names of the enabled collectors in the order they
+// are run.
+func (c *Config) EnabledCollectors() []string {
+	var names []string
+	for _, collector := range collectors {
+		if c.Collectors[collector.Name] {
+			names = append(names, collector.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,51 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestConfigConnectionLabel(t *testing.T) {
+	for _, test := range []struct {
+		label        string
+		domainLabels []string
+		customLabels []CustomLabelRule
+		ok           bool
+	}{
+		{"connection", []string{"name"}, nil, true},
+		{"uri", []string{"name", "uuid"}, []CustomLabelRule{{Name: "team", XPath: "//team"}}, true},
+		{"connection-name", []string{"name"}, nil, false},
+		// Labels of domain metrics
+		{"domain", []string{"name"}, nil, false},
+		{"target_device", []string{"name"}, nil, false},
+		{"iothread", []string{"name"}, nil, false},
+		{"uuid", []string{"name"}, nil, false},
+		{"instance_name", []string{"uuid", "nova_instance_name"}, nil, false},
+		{"team", []string{"name"}, []CustomLabelRule{{Name: "team", XPath: "//team"}}, false},
+		// Labels of other metrics
+		{"pool", []string{"name"}, nil, false},
+		{"collector", []string{"name"}, nil, false},
+		{"call", []string{"name"}, nil, false},
+	} {
+		cfg := Config{
+			ConnectionLabel: test.label,
+			Connections:     []ConnectionConfig{{URI: "qemu:///system"}},
+			DomainLabels:    test.domainLabels,
+			CustomLabels:    CustomLabelsConfig{Labels: test.customLabels},
+		}
+		if err := cfg.validate(); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.label, err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"libvirt.org/go/libvirt"
+)
+
+const (
+	// Keepalive settings for the libvirt connection: a probe is sent every
+	// keepaliveInterval seconds and the connection is closed after
+	// keepaliveCount unanswered probes.
+	keepaliveInterval = 5
+	keepaliveCount    = 3
+
+	reconnectBackoffMin = time.Second
+	reconnectBackoffMax = time.Minute
+)
+
+var (
+	libvirtConnectionUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "connection", "up"),
+		"Whether the exporter currently holds an open connection to libvirt.",
+		nil,
+		nil)
+	libvirtConnectionReconnectsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "connection", "reconnects_total"),
+		"Number of times the connection to libvirt has been re-established.",
+		nil,
+		nil)
+	libvirtConnectionFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "connection", "failures_total"),
+		"Number of failed attempts to connect to libvirt.",
+		nil,
+		nil)
+)
+
+// StartEventLoop registers the default libvirt event loop implementation
+// and runs it in background. It is required for keepalive probes and close
+// callbacks, so it must be called before the first connection is opened.
+func StartEventLoop() error {
+	err := libvirt.EventRegisterDefaultImpl()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := libvirt.EventRunDefaultImpl(); err != nil {
+				log.Printf("Libvirt event loop failed: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// connState is an open libvirt connection. alive is cleared by its close
+// callback without taking any lock, as libvirt runs the callback holding
+// its own close callback lock.
+type connState struct {
+	conn  *libvirt.Connect
+	alive int32
+}
+
+func (s *connState) isAlive() bool {
+	return s != nil && atomic.LoadInt32(&s.alive) == 1
+}
+
+// LibvirtConnection holds a long-lived connection to libvirt and
+// re-establishes it with exponential backoff once it is lost.
+type LibvirtConnection struct {
+	// Accessed atomically, first for 64-bit alignment on 32-bit platforms
+	reconnects uint64
+	failures   uint64
+
+	uri string
+
+	// connectMu serializes Get calls, so that a single connect is in
+	// progress. It is held across libvirt calls, unlike mu.
+	connectMu sync.Mutex
+
+	mu          sync.Mutex
+	state       atomic.Value // *connState, nil if not connected
+	opened      bool         // true after the first successful connect
+	closed      bool         // true after Close, no more connects are allowed
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+// NewLibvirtConnection creates a connection handle for uri. The connection
+// itself is opened lazily on the first Get.
+func NewLibvirtConnection(uri string) *LibvirtConnection {
+	c := &LibvirtConnection{
+		uri: uri,
+	}
+	c.state.Store((*connState)(nil))
+	return c
+}
+
+// current returns the current connection, nil if there is none.
+func (c *LibvirtConnection) current() *connState {
+	return c.state.Load().(*connState)
+}
+
+// Get returns an open connection to libvirt, reconnecting if the previous
+// one has been lost. Every returned connection holds an additional
+// reference, the caller must Close it when done.
+func (c *LibvirtConnection) Get() (*libvirt.Connect, error) {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("connection to %s is closed", c.uri)
+	}
+	state := c.current()
+	if state.isAlive() {
+		// Ref does not talk to libvirtd, it is safe to hold mu, which
+		// keeps Close from releasing the connection meanwhile
+		err := state.conn.Ref()
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return state.conn, nil
+	}
+	c.state.Store((*connState)(nil))
+	c.mu.Unlock()
+	if state != nil {
+		release(state.conn)
+	}
+
+	state, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		release(state.conn)
+		return nil, fmt.Errorf("connection to %s is closed", c.uri)
+	}
+	c.state.Store(state)
+	err = state.conn.Ref()
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return state.conn, nil
+}
+
+// Invalidate marks conn as lost if it is still the current connection and
+// it is not alive anymore, so that the next Get reconnects. It should be
+// called when a libvirt call fails.
+func (c *LibvirtConnection) Invalidate(conn *libvirt.Connect) {
+	state := c.current()
+	if state == nil || state.conn != conn || !state.isAlive() {
+		return
+	}
+	if alive, err := conn.IsAlive(); err == nil && alive {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&state.alive, 1, 0) {
+		log.Printf("Connection to %s is not alive anymore", c.uri)
+	}
+}
+
+// Close releases the connection. It cannot be used after that.
+func (c *LibvirtConnection) Close() {
+	c.mu.Lock()
+	c.closed = true
+	state := c.current()
+	c.state.Store((*connState)(nil))
+	c.mu.Unlock()
+
+	if state != nil {
+		release(state.conn)
+	}
+}
+
+// Collect reports the state of the connection. It does not wait for a
+// connect in progress.
+func (c *LibvirtConnection) Collect(ch chan<- prometheus.Metric) {
+	var up float64
+	if c.current().isAlive() {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		libvirtConnectionUpDesc,
+		prometheus.GaugeValue,
+		up)
+	ch <- prometheus.MustNewConstMetric(
+		libvirtConnectionReconnectsDesc,
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.reconnects)))
+	ch <- prometheus.MustNewConstMetric(
+		libvirtConnectionFailuresDesc,
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.failures)))
+}
+
+// connect opens a new connection, unless the backoff since the last failed
+// attempt has not expired yet. Must be called with c.connectMu held and
+// c.mu not held, as opening a remote connection may take long.
+func (c *LibvirtConnection) connect() (*connState, error) {
+	c.mu.Lock()
+	nextAttempt := c.nextAttempt
+	c.mu.Unlock()
+	if now := time.Now(); now.Before(nextAttempt) {
+		return nil, fmt.Errorf("not reconnecting to %s for another %s", c.uri, nextAttempt.Sub(now).Round(time.Second))
+	}
+
+	conn, err := libvirt.NewConnect(c.uri)
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		c.mu.Lock()
+		if c.backoff == 0 {
+			c.backoff = reconnectBackoffMin
+		} else if c.backoff *= 2; c.backoff > reconnectBackoffMax {
+			c.backoff = reconnectBackoffMax
+		}
+		c.nextAttempt = time.Now().Add(c.backoff)
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	err = conn.SetKeepAlive(keepaliveInterval, keepaliveCount)
+	if err != nil {
+		// Keepalive is not supported by local drivers (e.g. test:///),
+		// those are closed explicitly only.
+		WriteErrorOnce("Failed to enable keepalive: "+err.Error(), "keepalive_unsupported")
+	}
+	state := &connState{conn: conn, alive: 1}
+	err = conn.RegisterCloseCallback(func(_ *libvirt.Connect, reason libvirt.ConnectCloseReason) {
+		if atomic.CompareAndSwapInt32(&state.alive, 1, 0) {
+			log.Printf("Connection to %s closed, reason %d", c.uri, reason)
+		}
+	})
+	if err != nil {
+		conn.Close()
+		atomic.AddUint64(&c.failures, 1)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.backoff = 0
+	c.nextAttempt = time.Time{}
+	reconnected := c.opened
+	c.opened = true
+	c.mu.Unlock()
+	if reconnected {
+		atomic.AddUint64(&c.reconnects, 1)
+		log.Printf("Reconnected to %s", c.uri)
+	}
+	return state, nil
+}
+
+// release unregisters the close callback of conn and drops the reference
+// held on it. It must not be called with c.mu held.
+func release(conn *libvirt.Connect) {
+	conn.UnregisterCloseCallback()
+	conn.Close()
+}
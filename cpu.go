@@ -0,0 +1,121 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tinkoff/libvirt-exporter/libvirtSchema"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type cpuSample struct {
+	cpuTime uint64 // nsec
+	at      time.Time
+}
+
+// CPUUtilisation computes the CPU utilisation of domains between
+// consecutive collections of an exporter.
+type CPUUtilisation struct {
+	mu      sync.Mutex
+	samples map[string]cpuSample // by domain UUID
+}
+
+// NewCPUUtilisation creates a CPUUtilisation without samples.
+func NewCPUUtilisation() *CPUUtilisation {
+	return &CPUUtilisation{samples: make(map[string]cpuSample)}
+}
+
+// Observe records the CPU time of a domain taken at the given time and
+// returns the utilisation since the previous sample, normalised to the
+// number of vCPUs. ok is false for the first sample of the domain or if its
+// CPU time has gone back, e.g. after a restart.
+func (u *CPUUtilisation) Observe(uuid string, cpuTime uint64, vcpus int, at time.Time) (utilisation float64, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	prev, found := u.samples[uuid]
+	u.samples[uuid] = cpuSample{cpuTime: cpuTime, at: at}
+	if !found || cpuTime < prev.cpuTime || !at.After(prev.at) || vcpus < 1 {
+		return 0, false
+	}
+	wall := at.Sub(prev.at).Nanoseconds()
+	return float64(cpuTime-prev.cpuTime) / float64(wall) / float64(vcpus), true
+}
+
+// Prune forgets the domains not observed since the given time, e.g.
+// removed or filtered out ones.
+func (u *CPUUtilisation) Prune(since time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for uuid, sample := range u.samples {
+		if sample.at.Before(since) {
+			delete(u.samples, uuid)
+		}
+	}
+}
+
+// domainVcpus returns the number of vCPUs of the domain set in the XML.
+// It is 0 if the number is missing.
+func domainVcpus(desc *libvirtSchema.Domain) int {
+	count := desc.Vcpu.Current
+	if count == "" {
+		count = desc.Vcpu.Count
+	}
+	vcpus, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0
+	}
+	return vcpus
+}
+
+// collectDomainCPU reports the CPU time of the domain split into user and
+// system time. The time spent in halt polling is not reported, as it is not
+// parsed by the libvirt binding in use.
+func collectDomainCPU(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	cpu := domain.Stat.Cpu
+	if cpu == nil {
+		return nil
+	}
+	if cpu.UserSet {
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainCPUUserDesc,
+			prometheus.CounterValue,
+			float64(cpu.User)/1e9,
+			domain.Name)
+	}
+	if cpu.SystemSet {
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainCPUSystemDesc,
+			prometheus.CounterValue,
+			float64(cpu.System)/1e9,
+			domain.Name)
+	}
+
+	if domain.CPUUtilisation != nil && cpu.TimeSet {
+		utilisation, ok := domain.CPUUtilisation.Observe(domain.UUID, cpu.Time, domainVcpus(&domain.Desc), domain.SampledAt)
+		if ok {
+			ch <- domain.MustNewConstMetric(
+				libvirtDomainCPUUtilisationDesc,
+				prometheus.GaugeValue,
+				utilisation,
+				domain.Name)
+		}
+	}
+
+	return nil
+}
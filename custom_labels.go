@@ -0,0 +1,354 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/antchfx/xpath"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// CustomLabelRule sets a label to the result of an XPath expression over
+// the domain XML.
+type CustomLabelRule struct {
+	Name  string `yaml:"name"`
+	XPath string `yaml:"xpath"`
+}
+
+// CustomLabelsConfig lists the labels of libvirt_domain_info_custom.
+type CustomLabelsConfig struct {
+	// Namespaces maps prefixes used in the expressions to namespace URIs.
+	// If it is empty, prefixes in the expressions match the prefixes of
+	// the domain XML as written.
+	Namespaces map[string]string `yaml:"namespaces"`
+	Labels     []CustomLabelRule `yaml:"labels"`
+}
+
+// CustomLabels reports labels extracted from the domain XML.
+type CustomLabels struct {
+	desc *prometheus.Desc
+
+	// Evaluation of an expression is not safe for concurrent use
+	mu    sync.Mutex
+	exprs []*xpath.Expr
+}
+
+// NewCustomLabels compiles the rules of cfg. The labels are reported along
+// with the identity labels of policy. It returns nil if there are no rules.
+func NewCustomLabels(cfg CustomLabelsConfig, policy *LabelPolicy) (*CustomLabels, error) {
+	if len(cfg.Labels) == 0 {
+		return nil, nil
+	}
+	c := &CustomLabels{}
+	names := []string{"domain"}
+	seen := make(map[string]bool)
+	for _, rule := range cfg.Labels {
+		if !model.LabelName(rule.Name).IsValid() || strings.HasPrefix(rule.Name, "__") {
+			return nil, fmt.Errorf("invalid custom label name %q", rule.Name)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("duplicate custom label %q", rule.Name)
+		}
+		for _, label := range identityLabels {
+			if label.name == rule.Name {
+				return nil, fmt.Errorf("custom label %q conflicts with a domain label", rule.Name)
+			}
+		}
+		seen[rule.Name] = true
+		var expr *xpath.Expr
+		var err error
+		if len(cfg.Namespaces) > 0 {
+			expr, err = xpath.CompileWithNS(rule.XPath, cfg.Namespaces)
+		} else {
+			expr, err = xpath.Compile(rule.XPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("custom label %s: %s", rule.Name, err)
+		}
+		names = append(names, rule.Name)
+		c.exprs = append(c.exprs, expr)
+	}
+	c.desc = policy.NewDesc(
+		prometheus.BuildFQName("libvirt", "domain_info", "custom"),
+		"Domain labels extracted from the domain XML by configured XPath expressions.",
+		names)
+	return c, nil
+}
+
+// Desc returns the desc of libvirt_domain_info_custom.
+func (c *CustomLabels) Desc() *prometheus.Desc {
+	return c.desc
+}
+
+// Collect evaluates the expressions over the XML of the domain.
+func (c *CustomLabels) Collect(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	root, err := parseXMLTree(domain.XMLDesc)
+	if err != nil {
+		return err
+	}
+	values := []string{domain.Name}
+	c.mu.Lock()
+	for _, expr := range c.exprs {
+		values = append(values, evaluateXPath(expr, &xmlNavigator{root: root, curr: root, attr: -1}))
+	}
+	c.mu.Unlock()
+	ch <- domain.MustNewConstMetric(
+		c.desc,
+		prometheus.GaugeValue,
+		1,
+		values...)
+	return nil
+}
+
+// evaluateXPath returns the result of expr as a string. For a node set,
+// the value of the first node is returned.
+func evaluateXPath(expr *xpath.Expr, nav xpath.NodeNavigator) string {
+	switch result := expr.Evaluate(nav).(type) {
+	case string:
+		return result
+	case float64:
+		return strconv.FormatFloat(result, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(result)
+	case *xpath.NodeIterator:
+		if result.MoveNext() {
+			return result.Current().Value()
+		}
+	}
+	return ""
+}
+
+type xmlAttr struct {
+	name      xml.Name // Space is the prefix
+	namespace string
+	value     string
+}
+
+// xmlNode is a node of the domain XML keeping the namespace prefixes,
+// which encoding/xml replaces with namespace URIs.
+type xmlNode struct {
+	typ       xpath.NodeType
+	name      xml.Name // Space is the prefix
+	namespace string
+	attrs     []xmlAttr
+	text      string
+	parent    *xmlNode
+	index     int // among the children of parent
+	children  []*xmlNode
+}
+
+func (n *xmlNode) appendChild(child *xmlNode) {
+	child.parent = n
+	child.index = len(n.children)
+	n.children = append(n.children, child)
+}
+
+func (n *xmlNode) value() string {
+	if n.typ == xpath.TextNode || n.typ == xpath.CommentNode {
+		return n.text
+	}
+	var b strings.Builder
+	for _, child := range n.children {
+		if child.typ != xpath.CommentNode {
+			b.WriteString(child.value())
+		}
+	}
+	return b.String()
+}
+
+// parseXMLTree parses an XML document into a tree of nodes.
+func parseXMLTree(doc string) (*xmlNode, error) {
+	root := &xmlNode{typ: xpath.RootNode}
+	curr := root
+	// Namespace declarations in scope of every open element
+	scopes := []map[string]string{{"xml": "http://www.w3.org/XML/1998/namespace"}}
+	resolve := func(prefix string) string {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if uri, ok := scopes[i][prefix]; ok {
+				return uri
+			}
+		}
+		return ""
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+			node := &xmlNode{typ: xpath.ElementNode, name: token.Name}
+			for _, attr := range token.Attr {
+				switch {
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					scope[""] = attr.Value
+				case attr.Name.Space == "xmlns":
+					scope[attr.Name.Local] = attr.Value
+				default:
+					node.attrs = append(node.attrs, xmlAttr{name: attr.Name, value: attr.Value})
+				}
+			}
+			scopes = append(scopes, scope)
+			node.namespace = resolve(node.name.Space)
+			for i := range node.attrs {
+				// Unprefixed attributes have no namespace
+				if node.attrs[i].name.Space != "" {
+					node.attrs[i].namespace = resolve(node.attrs[i].name.Space)
+				}
+			}
+			curr.appendChild(node)
+			curr = node
+		case xml.EndElement:
+			if curr.parent == nil || curr.name != token.Name {
+				return nil, fmt.Errorf("unexpected end element %s", token.Name.Local)
+			}
+			scopes = scopes[:len(scopes)-1]
+			curr = curr.parent
+		case xml.CharData:
+			curr.appendChild(&xmlNode{typ: xpath.TextNode, text: string(token)})
+		case xml.Comment:
+			curr.appendChild(&xmlNode{typ: xpath.CommentNode, text: string(token)})
+		}
+	}
+	if curr != root {
+		return nil, fmt.Errorf("unclosed element %s", curr.name.Local)
+	}
+	return root, nil
+}
+
+// xmlNavigator implements xpath.NodeNavigator over a tree of nodes.
+type xmlNavigator struct {
+	root *xmlNode
+	curr *xmlNode
+	attr int // index of the current attribute of curr, -1 if none
+}
+
+func (n *xmlNavigator) NodeType() xpath.NodeType {
+	if n.attr != -1 {
+		return xpath.AttributeNode
+	}
+	return n.curr.typ
+}
+
+func (n *xmlNavigator) LocalName() string {
+	if n.attr != -1 {
+		return n.curr.attrs[n.attr].name.Local
+	}
+	return n.curr.name.Local
+}
+
+func (n *xmlNavigator) Prefix() string {
+	if n.attr != -1 {
+		return n.curr.attrs[n.attr].name.Space
+	}
+	return n.curr.name.Space
+}
+
+// NamespaceURL is used by xpath to match prefixes set with CompileWithNS.
+func (n *xmlNavigator) NamespaceURL() string {
+	if n.attr != -1 {
+		return n.curr.attrs[n.attr].namespace
+	}
+	return n.curr.namespace
+}
+
+func (n *xmlNavigator) Value() string {
+	if n.attr != -1 {
+		return n.curr.attrs[n.attr].value
+	}
+	return n.curr.value()
+}
+
+func (n *xmlNavigator) Copy() xpath.NodeNavigator {
+	c := *n
+	return &c
+}
+
+func (n *xmlNavigator) MoveToRoot() {
+	n.curr = n.root
+	n.attr = -1
+}
+
+func (n *xmlNavigator) MoveToParent() bool {
+	if n.attr != -1 {
+		n.attr = -1
+		return true
+	}
+	if n.curr.parent == nil {
+		return false
+	}
+	n.curr = n.curr.parent
+	return true
+}
+
+func (n *xmlNavigator) MoveToNextAttribute() bool {
+	if n.attr+1 >= len(n.curr.attrs) {
+		return false
+	}
+	n.attr++
+	return true
+}
+
+func (n *xmlNavigator) MoveToChild() bool {
+	if n.attr != -1 || len(n.curr.children) == 0 {
+		return false
+	}
+	n.curr = n.curr.children[0]
+	return true
+}
+
+func (n *xmlNavigator) MoveToFirst() bool {
+	if n.attr != -1 || n.curr.parent == nil {
+		return false
+	}
+	n.curr = n.curr.parent.children[0]
+	return true
+}
+
+func (n *xmlNavigator) MoveToNext() bool {
+	if n.attr != -1 || n.curr.parent == nil || n.curr.index+1 >= len(n.curr.parent.children) {
+		return false
+	}
+	n.curr = n.curr.parent.children[n.curr.index+1]
+	return true
+}
+
+func (n *xmlNavigator) MoveToPrevious() bool {
+	if n.attr != -1 || n.curr.parent == nil || n.curr.index == 0 {
+		return false
+	}
+	n.curr = n.curr.parent.children[n.curr.index-1]
+	return true
+}
+
+func (n *xmlNavigator) MoveTo(other xpath.NodeNavigator) bool {
+	o, ok := other.(*xmlNavigator)
+	if !ok || o.root != n.root {
+		return false
+	}
+	*n = *o
+	return true
+}
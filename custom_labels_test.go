@@ -0,0 +1,130 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/antchfx/xpath"
+)
+
+const testDomainXML = `<domain type='kvm'>
+  <name>instance-00000001</name>
+  <title>My VM</title>
+  <metadata>
+    <nova:instance xmlns:nova="http://openstack.org/xmlns/libvirt/nova/1.0">
+      <nova:name>vm1</nova:name>
+      <nova:owner>
+        <nova:project uuid="0b5b9bc4">demo</nova:project>
+      </nova:owner>
+    </nova:instance>
+    <orch:info xmlns:orch="http://example.com/orchestrator/1.0" orch:zone="a" team="infra">
+      <orch:cluster>c1</orch:cluster>
+    </orch:info>
+    <app xmlns="http://example.com/app/1.0"><tier>web</tier></app>
+  </metadata>
+  <devices>
+    <disk device='disk'/>
+    <disk device='cdrom'/>
+  </devices>
+</domain>`
+
+func TestEvaluateXPath(t *testing.T) {
+	namespaces := map[string]string{
+		"o": "http://example.com/orchestrator/1.0",
+		"a": "http://example.com/app/1.0",
+	}
+	for _, test := range []struct {
+		expr       string
+		namespaces map[string]string
+		want       string
+	}{
+		{"/domain/title", nil, "My VM"},
+		{"/domain/@type", nil, "kvm"},
+		{"//disk[@device='cdrom']/@device", nil, "cdrom"},
+		{"/domain/devices/disk/@device", nil, "disk"},
+		{"/domain/missing", nil, ""},
+		// Prefixes as written in the domain XML
+		{"//nova:name", nil, "vm1"},
+		{"/domain/metadata/nova:instance/nova:owner/nova:project/@uuid", nil, "0b5b9bc4"},
+		{"//orch:info/@orch:zone", nil, "a"},
+		{"//*[local-name()='cluster']", nil, "c1"},
+		// Prefixes bound to namespace URIs
+		{"//o:info/@team", namespaces, "infra"},
+		{"//o:info/@o:zone", namespaces, "a"},
+		{"//o:cluster", namespaces, "c1"},
+		{"//a:app/a:tier", namespaces, "web"},
+		// Other result types
+		{"string(//nova:project)", nil, "demo"},
+		{"concat(/domain/name, '/', //nova:name)", nil, "instance-00000001/vm1"},
+		{"count(//disk)", nil, "2"},
+		{"count(//disk) > 1", nil, "true"},
+	} {
+		var expr *xpath.Expr
+		var err error
+		if test.namespaces != nil {
+			expr, err = xpath.CompileWithNS(test.expr, test.namespaces)
+		} else {
+			expr, err = xpath.Compile(test.expr)
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		root, err := parseXMLTree(testDomainXML)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := evaluateXPath(expr, &xmlNavigator{root: root, curr: root, attr: -1})
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParseXMLTreeInvalid(t *testing.T) {
+	for _, doc := range []string{
+		"<domain>",
+		"<domain></devices>",
+		"</domain>",
+	} {
+		if _, err := parseXMLTree(doc); err == nil {
+			t.Errorf("%q: no error", doc)
+		}
+	}
+}
+
+func TestNewCustomLabels(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		cfg  CustomLabelsConfig
+		ok   bool
+	}{
+		{"no labels", CustomLabelsConfig{}, true},
+		{"valid", CustomLabelsConfig{Labels: []CustomLabelRule{{Name: "team", XPath: "//team"}}}, true},
+		{"invalid name", CustomLabelsConfig{Labels: []CustomLabelRule{{Name: "a-b", XPath: "//team"}}}, false},
+		{"reserved name", CustomLabelsConfig{Labels: []CustomLabelRule{{Name: "__team", XPath: "//team"}}}, false},
+		{"domain label", CustomLabelsConfig{Labels: []CustomLabelRule{{Name: "uuid", XPath: "//uuid"}}}, false},
+		{"duplicate", CustomLabelsConfig{Labels: []CustomLabelRule{{Name: "team", XPath: "//a"}, {Name: "team", XPath: "//b"}}}, false},
+		{"invalid expression", CustomLabelsConfig{Labels: []CustomLabelRule{{Name: "team", XPath: "//["}}}, false},
+		{"unbound prefix", CustomLabelsConfig{
+			Namespaces: map[string]string{"o": "http://example.com/orchestrator/1.0"},
+			Labels:     []CustomLabelRule{{Name: "team", XPath: "//x:team"}},
+		}, false},
+	} {
+		_, err := NewCustomLabels(test.cfg, &LabelPolicy{})
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/Tinkoff/libvirt-exporter/libvirtSchema"
+	"libvirt.org/go/libvirt"
+)
+
+// domainStateNames maps domain states to the names used in configuration.
+var domainStateNames = map[libvirt.DomainState]string{
+	libvirt.DOMAIN_NOSTATE:     "nostate",
+	libvirt.DOMAIN_RUNNING:     "running",
+	libvirt.DOMAIN_BLOCKED:     "blocked",
+	libvirt.DOMAIN_PAUSED:      "paused",
+	libvirt.DOMAIN_SHUTDOWN:    "shutdown",
+	libvirt.DOMAIN_SHUTOFF:     "shutoff",
+	libvirt.DOMAIN_CRASHED:     "crashed",
+	libvirt.DOMAIN_PMSUSPENDED: "pmsuspended",
+}
+
+// domainStateReasonNames maps reasons of every domain state to their names.
+var domainStateReasonNames = map[libvirt.DomainState]map[int]string{
+	libvirt.DOMAIN_NOSTATE: {
+		int(libvirt.DOMAIN_NOSTATE_UNKNOWN): "unknown",
+	},
+	libvirt.DOMAIN_RUNNING: {
+		int(libvirt.DOMAIN_RUNNING_UNKNOWN):            "unknown",
+		int(libvirt.DOMAIN_RUNNING_BOOTED):             "booted",
+		int(libvirt.DOMAIN_RUNNING_MIGRATED):           "migrated",
+		int(libvirt.DOMAIN_RUNNING_RESTORED):           "restored",
+		int(libvirt.DOMAIN_RUNNING_FROM_SNAPSHOT):      "from_snapshot",
+		int(libvirt.DOMAIN_RUNNING_UNPAUSED):           "unpaused",
+		int(libvirt.DOMAIN_RUNNING_MIGRATION_CANCELED): "migration_canceled",
+		int(libvirt.DOMAIN_RUNNING_SAVE_CANCELED):      "save_canceled",
+		int(libvirt.DOMAIN_RUNNING_WAKEUP):             "wakeup",
+		int(libvirt.DOMAIN_RUNNING_CRASHED):            "crashed",
+		int(libvirt.DOMAIN_RUNNING_POSTCOPY):           "postcopy",
+	},
+	libvirt.DOMAIN_BLOCKED: {
+		int(libvirt.DOMAIN_BLOCKED_UNKNOWN): "unknown",
+	},
+	libvirt.DOMAIN_PAUSED: {
+		int(libvirt.DOMAIN_PAUSED_UNKNOWN):         "unknown",
+		int(libvirt.DOMAIN_PAUSED_USER):            "user",
+		int(libvirt.DOMAIN_PAUSED_MIGRATION):       "migration",
+		int(libvirt.DOMAIN_PAUSED_SAVE):            "save",
+		int(libvirt.DOMAIN_PAUSED_DUMP):            "dump",
+		int(libvirt.DOMAIN_PAUSED_IOERROR):         "ioerror",
+		int(libvirt.DOMAIN_PAUSED_WATCHDOG):        "watchdog",
+		int(libvirt.DOMAIN_PAUSED_FROM_SNAPSHOT):   "from_snapshot",
+		int(libvirt.DOMAIN_PAUSED_SHUTTING_DOWN):   "shutting_down",
+		int(libvirt.DOMAIN_PAUSED_SNAPSHOT):        "snapshot",
+		int(libvirt.DOMAIN_PAUSED_CRASHED):         "crashed",
+		int(libvirt.DOMAIN_PAUSED_STARTING_UP):     "starting_up",
+		int(libvirt.DOMAIN_PAUSED_POSTCOPY):        "postcopy",
+		int(libvirt.DOMAIN_PAUSED_POSTCOPY_FAILED): "postcopy_failed",
+	},
+	libvirt.DOMAIN_SHUTDOWN: {
+		int(libvirt.DOMAIN_SHUTDOWN_UNKNOWN): "unknown",
+		int(libvirt.DOMAIN_SHUTDOWN_USER):    "user",
+	},
+	libvirt.DOMAIN_SHUTOFF: {
+		int(libvirt.DOMAIN_SHUTOFF_UNKNOWN):       "unknown",
+		int(libvirt.DOMAIN_SHUTOFF_SHUTDOWN):      "shutdown",
+		int(libvirt.DOMAIN_SHUTOFF_DESTROYED):     "destroyed",
+		int(libvirt.DOMAIN_SHUTOFF_CRASHED):       "crashed",
+		int(libvirt.DOMAIN_SHUTOFF_MIGRATED):      "migrated",
+		int(libvirt.DOMAIN_SHUTOFF_SAVED):         "saved",
+		int(libvirt.DOMAIN_SHUTOFF_FAILED):        "failed",
+		int(libvirt.DOMAIN_SHUTOFF_FROM_SNAPSHOT): "from_snapshot",
+		int(libvirt.DOMAIN_SHUTOFF_DAEMON):        "daemon",
+	},
+	libvirt.DOMAIN_CRASHED: {
+		int(libvirt.DOMAIN_CRASHED_UNKNOWN):  "unknown",
+		int(libvirt.DOMAIN_CRASHED_PANICKED): "panicked",
+	},
+	libvirt.DOMAIN_PMSUSPENDED: {
+		int(libvirt.DOMAIN_PMSUSPENDED_UNKNOWN): "unknown",
+	},
+}
+
+// domainStateName returns the name of a domain state. States unknown to
+// the exporter are named by their number.
+func domainStateName(state libvirt.DomainState) string {
+	if name, ok := domainStateNames[state]; ok {
+		return name
+	}
+	return strconv.Itoa(int(state))
+}
+
+// domainStateReasonName returns the name of the reason of a domain state.
+// Reasons unknown to the exporter, e.g. added by a newer libvirt, are named
+// by their number.
+func domainStateReasonName(state libvirt.DomainState, reason int) string {
+	if name, ok := domainStateReasonNames[state][reason]; ok {
+		return name
+	}
+	return strconv.Itoa(reason)
+}
+
+// DomainFilterRule matches domains having all of the set properties.
+type DomainFilterRule struct {
+	// Name is a regular expression matching the whole domain name.
+	Name  string   `yaml:"name"`
+	UUIDs []string `yaml:"uuids"`
+	// States are names of domain states, e.g. running or shutoff.
+	States []string `yaml:"states"`
+	// NovaProjects are names or UUIDs of Nova projects owning the domain.
+	NovaProjects []string `yaml:"nova_projects"`
+	// NovaFlavors are names of Nova flavors of the domain.
+	NovaFlavors []string `yaml:"nova_flavors"`
+}
+
+// DomainFilterConfig selects domains to collect. A domain is collected if
+// it matches any of Include rules, or there are none, and it matches none
+// of Exclude rules.
+type DomainFilterConfig struct {
+	Include []DomainFilterRule `yaml:"include"`
+	Exclude []DomainFilterRule `yaml:"exclude"`
+}
+
+type domainRule struct {
+	name     *regexp.Regexp
+	uuids    map[string]struct{}
+	states   map[libvirt.DomainState]struct{}
+	projects map[string]struct{}
+	flavors  map[string]struct{}
+}
+
+// DomainFilter decides which domains are collected.
+type DomainFilter struct {
+	include []*domainRule
+	exclude []*domainRule
+}
+
+// NewDomainFilter compiles the filter rules.
+func NewDomainFilter(cfg DomainFilterConfig) (*DomainFilter, error) {
+	f := &DomainFilter{}
+	for i, rule := range cfg.Include {
+		r, err := newDomainRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("include rule %d: %s", i, err)
+		}
+		f.include = append(f.include, r)
+	}
+	for i, rule := range cfg.Exclude {
+		r, err := newDomainRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("exclude rule %d: %s", i, err)
+		}
+		f.exclude = append(f.exclude, r)
+	}
+	return f, nil
+}
+
+func newDomainRule(rule DomainFilterRule) (*domainRule, error) {
+	r := &domainRule{}
+	if rule.Name != "" {
+		re, err := regexp.Compile("^(?:" + rule.Name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid name regexp: %s", err)
+		}
+		r.name = re
+	}
+	if len(rule.States) > 0 {
+		r.states = make(map[libvirt.DomainState]struct{})
+	}
+	for _, name := range rule.States {
+		found := false
+		for state, stateName := range domainStateNames {
+			if stateName == name {
+				r.states[state] = struct{}{}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown domain state %q", name)
+		}
+	}
+	r.uuids = stringSet(rule.UUIDs)
+	r.projects = stringSet(rule.NovaProjects)
+	r.flavors = stringSet(rule.NovaFlavors)
+	return r, nil
+}
+
+func stringSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{})
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
+}
+
+// match reports whether the rule matches the domain. If desc is nil and
+// the result depends on the domain metadata, ok is false.
+func (r *domainRule) match(name, uuid string, state libvirt.DomainState, desc *libvirtSchema.Domain) (matched, ok bool) {
+	if r.name != nil && !r.name.MatchString(name) {
+		return false, true
+	}
+	if r.uuids != nil {
+		if _, found := r.uuids[uuid]; !found {
+			return false, true
+		}
+	}
+	if r.states != nil {
+		if _, found := r.states[state]; !found {
+			return false, true
+		}
+	}
+	if r.projects == nil && r.flavors == nil {
+		return true, true
+	}
+	if desc == nil {
+		return false, false
+	}
+	instance := desc.Metadata.NovaInstance
+	if r.projects != nil {
+		_, byName := r.projects[instance.NovaOwner.NovaProject.ProjectName]
+		_, byUUID := r.projects[instance.NovaOwner.NovaProject.ProjectUUID]
+		if !byName && !byUUID {
+			return false, true
+		}
+	}
+	if r.flavors != nil {
+		if _, found := r.flavors[instance.NovaFlavor.FlavorName]; !found {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// Keep reports whether the domain should be collected. desc may be nil if
+// the domain XML has not been fetched yet, then ok is false if the decision
+// depends on the domain metadata.
+func (f *DomainFilter) Keep(name, uuid string, state libvirt.DomainState, desc *libvirtSchema.Domain) (keep, ok bool) {
+	if len(f.include) > 0 {
+		included, decided := false, true
+		for _, rule := range f.include {
+			matched, ok := rule.match(name, uuid, state, desc)
+			if matched {
+				included = true
+				break
+			}
+			decided = decided && ok
+		}
+		if !included {
+			return false, decided
+		}
+	}
+	decided := true
+	for _, rule := range f.exclude {
+		matched, ok := rule.match(name, uuid, state, desc)
+		if matched {
+			return false, true
+		}
+		decided = decided && ok
+	}
+	return decided, decided
+}
@@ -0,0 +1,183 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Tinkoff/libvirt-exporter/libvirtSchema"
+	"libvirt.org/go/libvirt"
+)
+
+func TestDomainFilterKeep(t *testing.T) {
+	var desc libvirtSchema.Domain
+	desc.Metadata.NovaInstance.NovaOwner.NovaProject = libvirtSchema.Project{ProjectName: "demo", ProjectUUID: "0b5b9bc4"}
+	desc.Metadata.NovaInstance.NovaFlavor.FlavorName = "m1.small"
+
+	for _, test := range []struct {
+		name  string
+		cfg   DomainFilterConfig
+		state libvirt.DomainState
+		// Result before the domain XML is fetched
+		keep, decided bool
+		// Result with the domain XML
+		keepWithXML bool
+	}{
+		{
+			name:        "no rules",
+			keep:        true,
+			decided:     true,
+			keepWithXML: true,
+		},
+		{
+			name:        "included by name",
+			cfg:         DomainFilterConfig{Include: []DomainFilterRule{{Name: "web-.*"}}},
+			keep:        true,
+			decided:     true,
+			keepWithXML: true,
+		},
+		{
+			name:    "name matches the whole domain name",
+			cfg:     DomainFilterConfig{Include: []DomainFilterRule{{Name: "web"}}},
+			decided: true,
+		},
+		{
+			name:        "name alternatives match the whole domain name",
+			cfg:         DomainFilterConfig{Include: []DomainFilterRule{{Name: "db|web-1"}}},
+			keep:        true,
+			decided:     true,
+			keepWithXML: true,
+		},
+		{
+			name:        "included by state",
+			cfg:         DomainFilterConfig{Include: []DomainFilterRule{{States: []string{"paused", "running"}}}},
+			state:       libvirt.DOMAIN_RUNNING,
+			keep:        true,
+			decided:     true,
+			keepWithXML: true,
+		},
+		{
+			name:    "not included by state",
+			cfg:     DomainFilterConfig{Include: []DomainFilterRule{{States: []string{"running"}}}},
+			state:   libvirt.DOMAIN_SHUTOFF,
+			decided: true,
+		},
+		{
+			name:    "rule properties must all match",
+			cfg:     DomainFilterConfig{Include: []DomainFilterRule{{Name: "web-.*", UUIDs: []string{"other"}}}},
+			decided: true,
+		},
+		{
+			name: "exclude takes precedence over include",
+			cfg: DomainFilterConfig{
+				Include: []DomainFilterRule{{Name: "web-.*"}},
+				Exclude: []DomainFilterRule{{UUIDs: []string{"6f1c3e2a"}}},
+			},
+			decided: true,
+		},
+		{
+			name:        "included by project name",
+			cfg:         DomainFilterConfig{Include: []DomainFilterRule{{NovaProjects: []string{"demo"}}}},
+			keepWithXML: true,
+		},
+		{
+			name:        "included by project UUID",
+			cfg:         DomainFilterConfig{Include: []DomainFilterRule{{NovaProjects: []string{"0b5b9bc4"}}}},
+			keepWithXML: true,
+		},
+		{
+			name: "not included by project",
+			cfg:  DomainFilterConfig{Include: []DomainFilterRule{{NovaProjects: []string{"other"}}}},
+		},
+		{
+			name:        "included by a rule without metadata",
+			cfg:         DomainFilterConfig{Include: []DomainFilterRule{{NovaProjects: []string{"other"}}, {Name: "web-.*"}}},
+			keep:        true,
+			decided:     true,
+			keepWithXML: true,
+		},
+		{
+			name:    "metadata rule excluded by name first",
+			cfg:     DomainFilterConfig{Include: []DomainFilterRule{{Name: "db-.*", NovaProjects: []string{"demo"}}}},
+			decided: true,
+		},
+		{
+			name: "excluded by flavor",
+			cfg:  DomainFilterConfig{Exclude: []DomainFilterRule{{NovaFlavors: []string{"m1.small"}}}},
+		},
+		{
+			name:        "not excluded by flavor",
+			cfg:         DomainFilterConfig{Exclude: []DomainFilterRule{{NovaFlavors: []string{"m1.large"}}}},
+			keepWithXML: true,
+		},
+		{
+			name: "excluded by name before metadata",
+			cfg: DomainFilterConfig{Exclude: []DomainFilterRule{
+				{NovaFlavors: []string{"m1.large"}},
+				{Name: "web-.*"},
+			}},
+			decided: true,
+		},
+	} {
+		filter, err := NewDomainFilter(test.cfg)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		keep, decided := filter.Keep("web-1", "6f1c3e2a", test.state, nil)
+		if keep != test.keep || decided != test.decided {
+			t.Errorf("%s: got keep %t, decided %t without XML, want %t, %t", test.name, keep, decided, test.keep, test.decided)
+		}
+		keep, decided = filter.Keep("web-1", "6f1c3e2a", test.state, &desc)
+		if keep != test.keepWithXML || !decided {
+			t.Errorf("%s: got keep %t, decided %t with XML, want %t, true", test.name, keep, decided, test.keepWithXML)
+		}
+	}
+}
+
+func TestNewDomainFilterInvalid(t *testing.T) {
+	for _, cfg := range []DomainFilterConfig{
+		{Include: []DomainFilterRule{{Name: "web-("}}},
+		{Exclude: []DomainFilterRule{{States: []string{"stopped"}}}},
+	} {
+		if _, err := NewDomainFilter(cfg); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
+
+func TestDomainStateNames(t *testing.T) {
+	for _, test := range []struct {
+		state      libvirt.DomainState
+		reason     int
+		name       string
+		reasonName string
+	}{
+		{libvirt.DOMAIN_RUNNING, int(libvirt.DOMAIN_RUNNING_MIGRATED), "running", "migrated"},
+		{libvirt.DOMAIN_PAUSED, int(libvirt.DOMAIN_PAUSED_IOERROR), "paused", "ioerror"},
+		{libvirt.DOMAIN_SHUTOFF, int(libvirt.DOMAIN_SHUTOFF_DESTROYED), "shutoff", "destroyed"},
+		// Reasons are specific to the state
+		{libvirt.DOMAIN_CRASHED, int(libvirt.DOMAIN_CRASHED_PANICKED), "crashed", "panicked"},
+		{libvirt.DOMAIN_BLOCKED, int(libvirt.DOMAIN_CRASHED_PANICKED), "blocked", "1"},
+		// Added by a newer libvirt
+		{libvirt.DOMAIN_RUNNING, 99, "running", "99"},
+		{libvirt.DomainState(42), 0, "42", "0"},
+	} {
+		if name := domainStateName(test.state); name != test.name {
+			t.Errorf("state %d: got %q, want %q", test.state, name, test.name)
+		}
+		if name := domainStateReasonName(test.state, test.reason); name != test.reasonName {
+			t.Errorf("state %d reason %d: got %q, want %q", test.state, test.reason, name, test.reasonName)
+		}
+	}
+}
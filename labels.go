@@ -0,0 +1,185 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// domainDesc holds the definition of a domain metric, so that it can be
+// re-created with the identity labels of a label policy. Its first variable
+// label is always "domain", set to the domain name.
+type domainDesc struct {
+	fqName         string
+	help           string
+	variableLabels []string
+	constLabels    prometheus.Labels
+}
+
+var domainDescs = make(map[*prometheus.Desc]domainDesc)
+
+// newDomainDesc creates the desc of a metric labelled by domain.
+func newDomainDesc(fqName, help string, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	desc := prometheus.NewDesc(fqName, help, variableLabels, constLabels)
+	domainDescs[desc] = domainDesc{
+		fqName:         fqName,
+		help:           help,
+		variableLabels: variableLabels,
+		constLabels:    constLabels,
+	}
+	return desc
+}
+
+type identityLabel struct {
+	name  string
+	value func(domain *DomainContext) string
+}
+
+// identityLabels maps names used in configuration to the labels
+// identifying a domain.
+var identityLabels = map[string]identityLabel{
+	"name": {"domain", func(domain *DomainContext) string {
+		return domain.Name
+	}},
+	"uuid": {"uuid", func(domain *DomainContext) string {
+		return domain.UUID
+	}},
+	"nova_instance_name": {"instance_name", func(domain *DomainContext) string {
+		return domain.Desc.Metadata.NovaInstance.NovaName
+	}},
+	"nova_project_uuid": {"project_uuid", func(domain *DomainContext) string {
+		return domain.Desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectUUID
+	}},
+	"title": {"title", func(domain *DomainContext) string {
+		return domain.Desc.Title
+	}},
+}
+
+// DefaultDomainLabels label domain metrics with the domain name only.
+var DefaultDomainLabels = []string{"name"}
+
+// LabelPolicy attaches the chosen identity labels to every domain metric
+// in place of the domain label.
+type LabelPolicy struct {
+	labels []identityLabel
+	descs  map[*prometheus.Desc]*prometheus.Desc
+	// skip maps descs to indexes of their label values replaced by the
+	// identity labels
+	skip map[*prometheus.Desc]map[int]bool
+}
+
+// NewLabelPolicy creates a label policy attaching the identity labels with
+// the given names, see identityLabels.
+func NewLabelPolicy(names []string) (*LabelPolicy, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no domain labels set")
+	}
+	p := &LabelPolicy{}
+	if len(names) == 1 && names[0] == "name" {
+		// The descs have the domain label already
+		return p, nil
+	}
+	p.descs = make(map[*prometheus.Desc]*prometheus.Desc)
+	p.skip = make(map[*prometheus.Desc]map[int]bool)
+	identity := make(map[string]bool)
+	for _, name := range names {
+		label, ok := identityLabels[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown domain label %q", name)
+		}
+		if identity[label.name] {
+			return nil, fmt.Errorf("duplicate domain label %q", name)
+		}
+		identity[label.name] = true
+		p.labels = append(p.labels, label)
+	}
+	if !identity["domain"] && !identity["uuid"] {
+		// Other labels may be empty or shared, e.g. for domains without
+		// Nova metadata, and the series would collide
+		return nil, fmt.Errorf("domain labels must include name or uuid")
+	}
+	for base, def := range domainDescs {
+		p.add(base, def)
+	}
+	return p, nil
+}
+
+// add creates the desc replacing base with the identity labels. The domain
+// label of libvirt_domain_info_meta is kept, so that it maps the identity
+// labels to the domain name and UUID whichever are chosen.
+func (p *LabelPolicy) add(base *prometheus.Desc, def domainDesc) {
+	var labels []string
+	identity := make(map[string]bool)
+	for _, label := range p.labels {
+		labels = append(labels, label.name)
+		identity[label.name] = true
+	}
+	skip := make(map[int]bool)
+	for i, name := range def.variableLabels {
+		if identity[name] || (i == 0 && base != libvirtDomainInfoMetaDesc) {
+			// The identity labels are set already
+			skip[i] = true
+			continue
+		}
+		labels = append(labels, name)
+	}
+	p.descs[base] = prometheus.NewDesc(def.fqName, def.help, labels, def.constLabels)
+	p.skip[base] = skip
+}
+
+// NewDesc creates the desc of a domain metric defined along with the
+// policy, e.g. with labels set by configuration. As in newDomainDesc, the
+// first variable label must be "domain". NewDesc must not be called once
+// the policy is in use.
+func (p *LabelPolicy) NewDesc(fqName, help string, variableLabels []string) *prometheus.Desc {
+	desc := prometheus.NewDesc(fqName, help, variableLabels, nil)
+	if p.descs != nil {
+		p.add(desc, domainDesc{
+			fqName:         fqName,
+			help:           help,
+			variableLabels: variableLabels,
+		})
+	}
+	return desc
+}
+
+// Desc returns the desc replacing base with the identity labels.
+func (p *LabelPolicy) Desc(base *prometheus.Desc) *prometheus.Desc {
+	if desc, ok := p.descs[base]; ok {
+		return desc
+	}
+	return base
+}
+
+// MustNewConstMetric creates a metric of the domain. labelValues are those
+// of desc, starting with the domain name, they are replaced with the
+// identity labels of the label policy.
+func (d *DomainContext) MustNewConstMetric(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) prometheus.Metric {
+	p := d.Labels
+	skip, ok := p.skip[desc]
+	if !ok {
+		return prometheus.MustNewConstMetric(desc, valueType, value, labelValues...)
+	}
+	values := make([]string, 0, len(p.labels)+len(labelValues))
+	for _, label := range p.labels {
+		values = append(values, label.value(d))
+	}
+	for i, labelValue := range labelValues {
+		if !skip[i] {
+			values = append(values, labelValue)
+		}
+	}
+	return prometheus.MustNewConstMetric(p.descs[desc], valueType, value, values...)
+}
@@ -0,0 +1,123 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"libvirt.org/go/libvirt"
+)
+
+func TestNewLabelPolicyInvalid(t *testing.T) {
+	for _, names := range [][]string{
+		nil,
+		{"hostname"},
+		{"name", "name"},
+		{"title"},
+		{"nova_instance_name", "nova_project_uuid"},
+	} {
+		if _, err := NewLabelPolicy(names); err == nil {
+			t.Errorf("%q: no error", names)
+		}
+	}
+}
+
+// metricLabels returns the labels of a metric by name.
+func metricLabels(t *testing.T, metric prometheus.Metric) map[string]string {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string)
+	for _, pair := range m.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestLabelPolicy(t *testing.T) {
+	domain := testDomainContext(libvirt.DomainStats{})
+	domain.UUID = "6f1c3e2a"
+	domain.Desc.Title = "Web server"
+	domain.Desc.Metadata.NovaInstance.NovaName = "web-1"
+	domain.Desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectUUID = "0b5b9bc4"
+
+	meta := []string{domain.Name, domain.UUID, "web-1", "m1.small", "admin", "a1", "demo", "0b5b9bc4", "image", "r1"}
+	metaLabels := func(identity map[string]string) map[string]string {
+		labels := map[string]string{
+			"domain":        domain.Name,
+			"uuid":          domain.UUID,
+			"instance_name": "web-1",
+			"flavor":        "m1.small",
+			"user_name":     "admin",
+			"user_uuid":     "a1",
+			"project_name":  "demo",
+			"project_uuid":  "0b5b9bc4",
+			"root_type":     "image",
+			"root_uuid":     "r1",
+		}
+		for name, value := range identity {
+			labels[name] = value
+		}
+		return labels
+	}
+
+	for _, test := range []struct {
+		names []string
+		block map[string]string
+		meta  map[string]string
+	}{
+		{
+			names: []string{"name"},
+			block: map[string]string{"domain": domain.Name, "target_device": "vda"},
+			meta:  metaLabels(nil),
+		},
+		{
+			names: []string{"uuid"},
+			block: map[string]string{"uuid": domain.UUID, "target_device": "vda"},
+			// The domain name is kept
+			meta: metaLabels(nil),
+		},
+		{
+			names: []string{"uuid", "title", "nova_instance_name"},
+			block: map[string]string{"uuid": domain.UUID, "title": "Web server", "instance_name": "web-1", "target_device": "vda"},
+			meta:  metaLabels(map[string]string{"title": "Web server"}),
+		},
+		{
+			names: []string{"name", "nova_project_uuid"},
+			block: map[string]string{"domain": domain.Name, "project_uuid": "0b5b9bc4", "target_device": "vda"},
+			meta:  metaLabels(nil),
+		},
+	} {
+		policy, err := NewLabelPolicy(test.names)
+		if err != nil {
+			t.Errorf("%q: %s", test.names, err)
+			continue
+		}
+		domain.Labels = policy
+
+		block := domain.MustNewConstMetric(libvirtDomainBlockRdBytesDesc, prometheus.CounterValue, 1, domain.Name, "vda")
+		if block.Desc() != policy.Desc(libvirtDomainBlockRdBytesDesc) {
+			t.Errorf("%q: metric desc differs from the policy desc", test.names)
+		}
+		if got := metricLabels(t, block); !reflect.DeepEqual(got, test.block) {
+			t.Errorf("%q: got block labels %v, want %v", test.names, got, test.block)
+		}
+		if got := metricLabels(t, domain.MustNewConstMetric(libvirtDomainInfoMetaDesc, prometheus.GaugeValue, 1, meta...)); !reflect.DeepEqual(got, test.meta) {
+			t.Errorf("%q: got meta labels %v, want %v", test.names, got, test.meta)
+		}
+	}
+}
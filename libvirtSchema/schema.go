@@ -14,10 +14,17 @@
 package libvirtSchema
 
 type Domain struct {
+	Title string `xml:"title"`
+	Vcpu Vcpu `xml:"vcpu"`
 	Devices Devices `xml:"devices"`
 	Metadata Metadata `xml:"metadata"`
 }
 
+type Vcpu struct {
+	Count string `xml:",chardata"`
+	Current string `xml:"current,attr"`
+}
+
 type Metadata struct {
 	NovaInstance Instance `xml:"instance"`
 }
@@ -56,6 +63,7 @@ type Root struct {
 type Devices struct {
 	Disks      []Disk      `xml:"disk"`
 	Interfaces []Interface `xml:"interface"`
+	MemBalloon MemBalloon  `xml:"memballoon"`
 }
 
 type Disk struct {
@@ -68,19 +76,23 @@ type Disk struct {
 }
 
 type DiskDriver struct {
-	Type    string `xml:"type,attr"`
-	Cache   string `xml:"cache,attr"`
-	Discard string `xml:"discard,attr"`
+	Type     string `xml:"type,attr"`
+	Cache    string `xml:"cache,attr"`
+	Discard  string `xml:"discard,attr"`
+	IOThread string `xml:"iothread,attr"`
 }
 
 type DiskSource struct {
 	File string `xml:"file,attr"`
 	Name string `xml:"name,attr"`
+	Dev string `xml:"dev,attr"`
+	Volume string `xml:"volume,attr"`
 }
 
 type DiskTarget struct {
 	Device string `xml:"dev,attr"`
 	Bus string `xml:"bus,attr"`
+	Tray string `xml:"tray,attr"`
 }
 
 type Interface struct {
@@ -104,13 +116,11 @@ type InterfaceTarget struct {
 	Device string `xml:"dev,attr"`
 }
 
-type VirDomainMemoryStats struct {
-	MajorFault    uint64
-	MinorFault    uint64
-	Unused         uint64
-	Available      uint64
-	ActualBalloon uint64
-	Rss            uint64
-	Usable         uint64
-	DiskCaches    uint64
+type MemBalloon struct {
+	Model string `xml:"model,attr"`
+	Stats MemBalloonStats `xml:"stats"`
+}
+
+type MemBalloonStats struct {
+	Period int `xml:"period,attr"`
 }
@@ -19,15 +19,19 @@ package main
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Tinkoff/libvirt-exporter/libvirtSchema"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"libvirt.org/go/libvirt"
 )
@@ -40,6 +44,26 @@ var (
 		"Whether scraping libvirt's metrics was successful.",
 		nil,
 		nil)
+	libvirtLastScrapePartialDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "", "last_scrape_partial"),
+		"Whether metrics of some domains were skipped during the last scrape because of errors.",
+		nil,
+		nil)
+	libvirtDomainScrapeErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "domain", "scrape_errors_total"),
+		"Number of failed attempts to collect metrics of a domain, by the stage that has failed.",
+		[]string{"domain", "stage"},
+		nil)
+	libvirtDomainsFilteredDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "", "domains_filtered_total"),
+		"Number of times a domain was skipped by the domain filter.",
+		nil,
+		nil)
+	libvirtSnapshotAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "", "snapshot_age_seconds"),
+		"Time since the served metrics were collected, in polling mode.",
+		nil,
+		nil)
 	libvirtPoolInfoCapacity = prometheus.NewDesc(
 		prometheus.BuildFQName("libvirt", "pool_info", "capacity_bytes"),
 		"Pool capacity, in bytes",
@@ -60,45 +84,158 @@ var (
 		"Versions of virtualization components",
 		[]string{"hypervisor_running", "libvirtd_running", "libvirt_library"},
 		nil)
-	libvirtDomainInfoMetaDesc = prometheus.NewDesc(
+	libvirtDomainInfoMetaDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_info", "meta"),
 		"Domain metadata",
 		[]string{"domain", "uuid", "instance_name", "flavor", "user_name", "user_uuid", "project_name", "project_uuid", "root_type", "root_uuid"},
 		nil)
-	libvirtDomainInfoMaxMemBytesDesc = prometheus.NewDesc(
+	libvirtDomainInfoMaxMemBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_info", "maximum_memory_bytes"),
 		"Maximum allowed memory of the domain, in bytes.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoMemoryUsageBytesDesc = prometheus.NewDesc(
+	libvirtDomainInfoMemoryUsageBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_info", "memory_usage_bytes"),
 		"Memory usage of the domain, in bytes.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoNrVirtCPUDesc = prometheus.NewDesc(
+	libvirtDomainInfoNrVirtCPUDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_info", "virtual_cpus"),
 		"Number of virtual CPUs for the domain.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoCPUTimeDesc = prometheus.NewDesc(
+	libvirtDomainInfoCPUTimeDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_info", "cpu_time_seconds_total"),
 		"Amount of CPU time used by the domain, in seconds.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainInfoVirDomainState = prometheus.NewDesc(
+	libvirtDomainInfoVirDomainState = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_info", "vstate"),
 		"Virtual domain state. 0: no state, 1: the domain is running, 2: the domain is blocked on resource,"+
 			" 3: the domain is paused by user, 4: the domain is being shut down, 5: the domain is shut off,"+
 			"6: the domain is crashed, 7: the domain is suspended by guest power management",
 		[]string{"domain"},
 		nil)
+	libvirtDomainCPUUserDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_cpu", "user_seconds_total"),
+		"User CPU time spent by the domain.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainCPUSystemDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_cpu", "system_seconds_total"),
+		"System CPU time spent by the domain.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainCPUUtilisationDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_cpu", "utilisation_ratio"),
+		"CPU utilisation of the domain between the last two collections, divided by the number of vCPUs.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainVcpuPinningInfoDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_vcpu", "pinning_info"),
+		"Host CPUs allowed to run the vCPU, in libvirt cpuset format.",
+		[]string{"domain", "vcpu", "cpuset"},
+		nil)
+	libvirtDomainEmulatorPinningInfoDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_emulator", "pinning_info"),
+		"Host CPUs allowed to run the emulator threads of the domain, in libvirt cpuset format.",
+		[]string{"domain", "cpuset"},
+		nil)
+	libvirtHostCPUPinnedVcpusDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "host_cpu", "pinned_vcpus"),
+		"Number of vCPUs of active domains pinned to the host CPU. vCPUs allowed to run on all host CPUs are not counted.",
+		[]string{"cpu"},
+		nil)
+	libvirtDomainIOThreadPinningInfoDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_iothread", "pinning_info"),
+		"Host CPUs allowed to run the IOThread, in libvirt cpuset format.",
+		[]string{"domain", "iothread", "cpuset"},
+		nil)
+	libvirtDomainSchedulerCPUSharesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "cpu_shares"),
+		"Relative CPU weight of the domain, cputune shares.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerGlobalPeriodDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "global_period_seconds"),
+		"Enforcement period of the quota of the whole domain.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerGlobalQuotaDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "global_quota_seconds"),
+		"CPU time the whole domain may use per global period, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerVcpuPeriodDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "vcpu_period_seconds"),
+		"Enforcement period of the quota of every vCPU.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerVcpuQuotaDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "vcpu_quota_seconds"),
+		"CPU time every vCPU may use per vCPU period, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerEmulatorPeriodDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "emulator_period_seconds"),
+		"Enforcement period of the quota of the emulator threads.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerEmulatorQuotaDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "emulator_quota_seconds"),
+		"CPU time the emulator threads may use per emulator period, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerIOThreadPeriodDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "iothread_period_seconds"),
+		"Enforcement period of the quota of every IOThread.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainSchedulerIOThreadQuotaDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_scheduler", "iothread_quota_seconds"),
+		"CPU time every IOThread may use per IOThread period, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemtuneHardLimitDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memtune", "hard_limit_bytes"),
+		"Maximum memory the domain may use, including the QEMU process, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemtuneSoftLimitDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memtune", "soft_limit_bytes"),
+		"Memory limit enforced on the domain under memory contention, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemtuneSwapHardLimitDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memtune", "swap_hard_limit_bytes"),
+		"Maximum memory plus swap the domain may use, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemtuneMinGuaranteeDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memtune", "min_guarantee_bytes"),
+		"Memory guaranteed to the domain, absent if unlimited.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainStateReasonDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain", "state_reason"),
+		"Reason of the current domain state, e.g. ioerror or migration for a paused domain. The value is "+
+			"the number of the reason in libvirt.",
+		[]string{"domain", "state", "reason"},
+		nil)
+
+	libvirtDomainStatsIncompleteDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain", "stats_incomplete"),
+		"Whether the stats of the domain are incomplete because its job could not be acquired without waiting, "+
+			"e.g. due to a hung QEMU monitor.",
+		[]string{"domain"},
+		nil)
 
-	libvirtDomainVcpuTimeDesc = prometheus.NewDesc(
+	libvirtDomainVcpuTimeDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_vcpu", "time_seconds_total"),
 		"Amount of CPU time used by the domain's VCPU, in seconds.",
 		[]string{"domain", "vcpu"},
 		nil)
-	libvirtDomainVcpuDelayDesc = prometheus.NewDesc(
+	libvirtDomainVcpuDelayDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_vcpu", "delay_seconds_total"),
 		"Amount of CPU time used by the domain's VCPU, in seconds. "+
 			"Vcpu's delay metric. Time the vcpu thread was enqueued by the "+
@@ -106,78 +243,88 @@ var (
 			"Exposed to the VM as a steal time.",
 		[]string{"domain", "vcpu"},
 		nil)
-	libvirtDomainVcpuStateDesc = prometheus.NewDesc(
+	libvirtDomainVcpuStateDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_vcpu", "state"),
 		"VCPU state. 0: offline, 1: running, 2: blocked",
 		[]string{"domain", "vcpu"},
 		nil)
-	libvirtDomainVcpuCPUDesc = prometheus.NewDesc(
+	libvirtDomainVcpuCPUDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_vcpu", "cpu"),
 		"Real CPU number, or one of the values from virVcpuHostCpuState",
 		[]string{"domain", "vcpu"},
 		nil)
-	libvirtDomainVcpuWaitDesc = prometheus.NewDesc(
+	libvirtDomainVcpuWaitDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_vcpu", "wait_seconds_total"),
 		"Vcpu's wait_sum metric. CONFIG_SCHEDSTATS has to be enabled",
 		[]string{"domain", "vcpu"},
 		nil)
 
-	libvirtDomainMetaBlockDesc = prometheus.NewDesc(
+	libvirtDomainMetaBlockDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block", "meta"),
 		"Block device metadata info. Device name, source file, serial.",
-		[]string{"domain", "target_device", "source_file", "serial", "bus", "disk_type", "driver_type", "cache", "discard"},
+		[]string{"domain", "target_device", "source_file", "serial", "bus", "disk_type", "driver_type", "cache", "discard", "device", "iothread"},
+		nil)
+	libvirtDomainBlockMediaInsertedDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_block", "media_inserted"),
+		"Whether a medium is inserted into a removable block device, e.g. cdrom or floppy.",
+		[]string{"domain", "target_device", "device"},
+		nil)
+	libvirtDomainBlockTrayOpenDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_block", "tray_open"),
+		"Whether the tray of a removable block device is open.",
+		[]string{"domain", "target_device", "device"},
 		nil)
-	libvirtDomainBlockRdBytesDesc = prometheus.NewDesc(
+	libvirtDomainBlockRdBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_bytes_total"),
 		"Number of bytes read from a block device, in bytes.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockRdReqDesc = prometheus.NewDesc(
+	libvirtDomainBlockRdReqDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_requests_total"),
 		"Number of read requests from a block device.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockRdTotalTimeSecondsDesc = prometheus.NewDesc(
+	libvirtDomainBlockRdTotalTimeSecondsDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "read_time_seconds_total"),
 		"Total time spent on reads from a block device, in seconds.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWrBytesDesc = prometheus.NewDesc(
+	libvirtDomainBlockWrBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_bytes_total"),
 		"Number of bytes written to a block device, in bytes.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWrReqDesc = prometheus.NewDesc(
+	libvirtDomainBlockWrReqDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_requests_total"),
 		"Number of write requests to a block device.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWrTotalTimesDesc = prometheus.NewDesc(
+	libvirtDomainBlockWrTotalTimesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "write_time_seconds_total"),
 		"Total time spent on writes on a block device, in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockFlushReqDesc = prometheus.NewDesc(
+	libvirtDomainBlockFlushReqDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_requests_total"),
 		"Total flush requests from a block device.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockFlushTotalTimeSecondsDesc = prometheus.NewDesc(
+	libvirtDomainBlockFlushTotalTimeSecondsDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "flush_time_seconds_total"),
 		"Total time in seconds spent on cache flushing to a block device",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockAllocationDesc = prometheus.NewDesc(
+	libvirtDomainBlockAllocationDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "allocation"),
 		"Offset of the highest written sector on a block device.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockCapacityBytesDesc = prometheus.NewDesc(
+	libvirtDomainBlockCapacityBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "capacity_bytes"),
 		"Logical size in bytes of the block device	backing image.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockPhysicalSizeBytesDesc = prometheus.NewDesc(
+	libvirtDomainBlockPhysicalSizeBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "physicalsize_bytes"),
 		"Physical size in bytes of the container of the backing image.",
 		[]string{"domain", "target_device"},
@@ -185,203 +332,362 @@ var (
 
 	// Block IO tune parameters
 	// Limits
-	libvirtDomainBlockTotalBytesSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockTotalBytesSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_total_bytes"),
 		"Total throughput limit in bytes per second",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWriteBytesSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockWriteBytesSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_write_bytes"),
 		"Write throughput limit in bytes per second",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockReadBytesSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockReadBytesSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_read_bytes"),
 		"Read throughput limit in bytes per second",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockTotalIopsSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockTotalIopsSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_total_requests"),
 		"Total requests per second limit",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWriteIopsSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockWriteIopsSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_write_requests"),
 		"Write requests per second limit",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockReadIopsSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockReadIopsSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_read_requests"),
 		"Read requests per second limit",
 		[]string{"domain", "target_device"},
 		nil)
 	// Burst limits
-	libvirtDomainBlockTotalBytesSecMaxDesc = prometheus.NewDesc(
+	libvirtDomainBlockTotalBytesSecMaxDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_total_bytes"),
 		"Total throughput burst limit in bytes per second",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWriteBytesSecMaxDesc = prometheus.NewDesc(
+	libvirtDomainBlockWriteBytesSecMaxDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_write_bytes"),
 		"Write throughput burst limit in bytes per second",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockReadBytesSecMaxDesc = prometheus.NewDesc(
+	libvirtDomainBlockReadBytesSecMaxDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_read_bytes"),
 		"Read throughput burst limit in bytes per second",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockTotalIopsSecMaxDesc = prometheus.NewDesc(
+	libvirtDomainBlockTotalIopsSecMaxDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_total_requests"),
 		"Total requests per second burst limit",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWriteIopsSecMaxDesc = prometheus.NewDesc(
+	libvirtDomainBlockWriteIopsSecMaxDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_write_requests"),
 		"Write requests per second burst limit",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockReadIopsSecMaxDesc = prometheus.NewDesc(
+	libvirtDomainBlockReadIopsSecMaxDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_read_requests"),
 		"Read requests per second burst limit",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockTotalBytesSecMaxLengthDesc = prometheus.NewDesc(
+	libvirtDomainBlockTotalBytesSecMaxLengthDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_total_bytes_length_seconds"),
 		"Total throughput burst time in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWriteBytesSecMaxLengthDesc = prometheus.NewDesc(
+	libvirtDomainBlockWriteBytesSecMaxLengthDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_write_bytes_length_seconds"),
 		"Write throughput burst time in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockReadBytesSecMaxLengthDesc = prometheus.NewDesc(
+	libvirtDomainBlockReadBytesSecMaxLengthDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_read_bytes_length_seconds"),
 		"Read throughput burst time in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockTotalIopsSecMaxLengthDesc = prometheus.NewDesc(
+	libvirtDomainBlockTotalIopsSecMaxLengthDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_length_total_requests_seconds"),
 		"Total requests per second burst time in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockWriteIopsSecMaxLengthDesc = prometheus.NewDesc(
+	libvirtDomainBlockWriteIopsSecMaxLengthDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_length_write_requests_seconds"),
 		"Write requests per second burst time in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockReadIopsSecMaxLengthDesc = prometheus.NewDesc(
+	libvirtDomainBlockReadIopsSecMaxLengthDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "limit_burst_length_read_requests_seconds"),
 		"Read requests per second burst time in seconds",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainBlockSizeIopsSecDesc = prometheus.NewDesc(
+	libvirtDomainBlockSizeIopsSecDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_block_stats", "size_iops_bytes"),
 		"The size of IO operations per second permitted through a block device",
 		[]string{"domain", "target_device"},
 		nil)
 
-	libvirtDomainMetaInterfacesDesc = prometheus.NewDesc(
+	libvirtDomainMetaInterfacesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface", "meta"),
 		"Interfaces metadata. Source bridge, target device, interface uuid",
 		[]string{"domain", "source_bridge", "target_device", "virtual_interface"},
 		nil)
-	libvirtDomainInterfaceRxBytesDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceRxBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_bytes_total"),
 		"Number of bytes received on a network interface, in bytes.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceRxPacketsDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceRxPacketsDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_packets_total"),
 		"Number of packets received on a network interface.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceRxErrsDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceRxErrsDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_errors_total"),
 		"Number of packet receive errors on a network interface.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceRxDropDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceRxDropDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "receive_drops_total"),
 		"Number of packet receive drops on a network interface.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceTxBytesDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceTxBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_bytes_total"),
 		"Number of bytes transmitted on a network interface, in bytes.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceTxPacketsDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceTxPacketsDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_packets_total"),
 		"Number of packets transmitted on a network interface.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceTxErrsDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceTxErrsDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_errors_total"),
 		"Number of packet transmit errors on a network interface.",
 		[]string{"domain", "target_device"},
 		nil)
-	libvirtDomainInterfaceTxDropDesc = prometheus.NewDesc(
+	libvirtDomainInterfaceTxDropDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_interface_stats", "transmit_drops_total"),
 		"Number of packet transmit drops on a network interface.",
 		[]string{"domain", "target_device"},
 		nil)
 
-	libvirtDomainMemoryStatMajorFaultTotalDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatAvailableDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "available"),
+		"Whether the balloon driver of the guest reports memory statistics. Without it, the statistics "+
+			"of the guest are not exported.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatPeriodDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "period_seconds"),
+		"Balloon stats period of the domain, the guest memory statistics are not refreshed if it is 0.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatPeriodChangePendingDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "period_change_pending"),
+		"Whether the balloon stats period of the domain differs from the configured one and is not changed, "+
+			"e.g. in dry-run mode.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatMajorFaultTotalDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "major_fault_total"),
 		"Page faults occur when a process makes a valid access to virtual memory that is not available. "+
 			"When servicing the page fault, if disk IO is required, it is considered a major fault.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatMinorFaultTotalDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatMinorFaultTotalDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "minor_fault_total"),
 		"Page faults occur when a process makes a valid access to virtual memory that is not available. "+
 			"When servicing the page not fault, if disk IO is required, it is considered a minor fault.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatUnusedBytesDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatUnusedBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "unused_bytes"),
 		"The amount of memory left completely unused by the system. Memory that is available but used for "+
 			"reclaimable caches should NOT be reported as free. This value is expressed in bytes.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatAvailableBytesDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatAvailableBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "available_bytes"),
 		"The total amount of usable memory as seen by the domain. This value may be less than the amount of "+
 			"memory assigned to the domain if a balloon driver is in use or if the guest OS does not initialize all "+
 			"assigned pages. This value is expressed in bytes.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatActualBaloonBytesDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatActualBaloonBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "actual_balloon_bytes"),
 		"Current balloon value (in bytes).",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatRssBytesDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatRssBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "rss_bytes"),
 		"Resident Set Size of the process running the domain. This value is in bytes",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatUsableBytesDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatUsableBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "usable_bytes"),
 		"How much the balloon can be inflated without pushing the guest system to swap, corresponds "+
 			"to 'Available' in /proc/meminfo",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatDiskCachesBytesDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatDiskCachesBytesDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "disk_cache_bytes"),
 		"The amount of memory, that can be quickly reclaimed without additional I/O (in bytes)."+
 			"Typically these pages are used for caching files from disk.",
 		[]string{"domain"},
 		nil)
-	libvirtDomainMemoryStatUsedPercentDesc = prometheus.NewDesc(
+	libvirtDomainMemoryStatMaximumBytesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "maximum_bytes"),
+		"Maximum balloon value, the memory the domain can be given (in bytes).",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatSwapInBytesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "swap_in_bytes_total"),
+		"The amount of data read from swap space by the domain (in bytes).",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatSwapOutBytesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "swap_out_bytes_total"),
+		"The amount of memory written out to swap space by the domain (in bytes).",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatLastUpdateDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "last_update_timestamp_seconds"),
+		"Timestamp of the last update of the balloon statistics by the guest.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatHugetlbPgAllocDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "hugetlb_pgalloc_total"),
+		"The number of successful huge page allocations in the domain.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatHugetlbPgFailDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_memory_stats", "hugetlb_pgfail_total"),
+		"The number of failed huge page allocations in the domain.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainMemoryStatUsedPercentDesc = newDomainDesc(
 		prometheus.BuildFQName("libvirt", "domain_memory_stats", "used_percent"),
 		"The amount of memory in percent, that used by domain.",
 		[]string{"domain"},
 		nil)
 
-	errorsMap map[string]struct{}
+	libvirtDomainPerfCmtDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "cmt_bytes"),
+		"Cache occupancy of the domain, perf cmt event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfMbmtDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "mbmt_bytes_per_second"),
+		"Total memory bandwidth of the domain from one level of cache, perf mbmt event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfMbmlDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "mbml_bytes_per_second"),
+		"Local memory bandwidth of the domain from one level of cache, perf mbml event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfCacheMissesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "cache_misses_total"),
+		"Cache misses of the domain, perf cache_misses event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfCacheReferencesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "cache_references_total"),
+		"Cache hits of the domain, perf cache_references event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfInstructionsDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "instructions_total"),
+		"Instructions executed by the domain, perf instructions event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfCPUCyclesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "cpu_cycles_total"),
+		"CPU cycles used by the domain, perf cpu_cycles event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfBranchInstructionsDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "branch_instructions_total"),
+		"Branch instructions executed by the domain, perf branch_instructions event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfBranchMissesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "branch_misses_total"),
+		"Branch misses of the domain, perf branch_misses event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfBusCyclesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "bus_cycles_total"),
+		"Bus cycles used by the domain, perf bus_cycles event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfStalledCyclesFrontendDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "stalled_cycles_frontend_total"),
+		"Stalled CPU cycles in the frontend of the instruction pipeline, perf stalled_cycles_frontend event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfStalledCyclesBackendDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "stalled_cycles_backend_total"),
+		"Stalled CPU cycles in the backend of the instruction pipeline, perf stalled_cycles_backend event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfRefCPUCyclesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "ref_cpu_cycles_total"),
+		"CPU cycles not affected by frequency scaling, perf ref_cpu_cycles event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfCPUClockDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "cpu_clock_seconds_total"),
+		"CPU clock time of the domain, perf cpu_clock event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfTaskClockDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "task_clock_seconds_total"),
+		"Task clock time of the domain, perf task_clock event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfPageFaultsDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "page_faults_total"),
+		"Page faults of the domain, perf page_faults event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfContextSwitchesDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "context_switches_total"),
+		"Context switches of the domain, perf context_switches event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfCPUMigrationsDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "cpu_migrations_total"),
+		"CPU migrations of the domain, perf cpu_migrations event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfPageFaultsMinDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "page_faults_minor_total"),
+		"Minor page faults of the domain, perf page_faults_min event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfPageFaultsMajDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "page_faults_major_total"),
+		"Major page faults of the domain, perf page_faults_maj event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfAlignmentFaultsDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "alignment_faults_total"),
+		"Alignment faults of the domain, perf alignment_faults event.",
+		[]string{"domain"},
+		nil)
+	libvirtDomainPerfEmulationFaultsDesc = newDomainDesc(
+		prometheus.BuildFQName("libvirt", "domain_perf", "emulation_faults_total"),
+		"Emulation faults of the domain, perf emulation_faults event.",
+		[]string{"domain"},
+		nil)
+
+	errorsMap     map[string]struct{}
+	errorsMapLock sync.Mutex
 )
 
 // WriteErrorOnce writes message to stdout only once
@@ -389,81 +695,354 @@ var (
 // "err" - an error message
 // "name" - name of an error, to count it
 func WriteErrorOnce(err string, name string) {
+	errorsMapLock.Lock()
+	defer errorsMapLock.Unlock()
 	if _, ok := errorsMap[name]; !ok {
 		log.Printf("%s", err)
 		errorsMap[name] = struct{}{}
 	}
 }
 
-// CollectDomain extracts Prometheus metrics from a libvirt domain.
-func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats) error {
+// DomainError describes a failure to collect metrics of a single domain.
+// Stage tells which step of the collection has failed.
+type DomainError struct {
+	Domain string
+	Stage  string
+	Err    error
+}
+
+func (e *DomainError) Error() string {
+	return fmt.Sprintf("domain %q, stage %s: %s", e.Domain, e.Stage, e.Err)
+}
+
+// errDomainFiltered is returned for domains skipped by the domain filter.
+var errDomainFiltered = errors.New("domain is filtered out")
+
+// domainStatsIncomplete reports whether libvirt has skipped the stats that
+// require a job on the domain. This happens with
+// CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT if the job is held by someone else,
+// e.g. when the QEMU monitor is stuck. Balloon rss is reported for every
+// active domain when the job is acquired, so its absence is used as a sign.
+func domainStatsIncomplete(stat libvirt.DomainStats) bool {
+	if stat.State == nil || stat.Balloon == nil {
+		return false
+	}
+	switch stat.State.State {
+	case libvirt.DOMAIN_RUNNING, libvirt.DOMAIN_BLOCKED, libvirt.DOMAIN_PAUSED:
+		return !stat.Balloon.RssSet
+	}
+	return false
+}
+
+// DomainPolicy holds the settings of an exporter applied to every domain.
+type DomainPolicy struct {
+	Filter       *DomainFilter
+	Labels       *LabelPolicy
+	CustomLabels *CustomLabels // nil if not configured
+	// BlockDeviceTypes are the types of block devices whose stats are
+	// exported, see blockDeviceTypes.
+	BlockDeviceTypes map[string]bool
+	// MemoryStatsPeriod is the balloon stats period set on domains.
+	MemoryStatsPeriod MemoryStatsPeriodConfig
+	// CPUUtilisation computes the CPU utilisation of domains, nil if it is
+	// disabled.
+	CPUUtilisation *CPUUtilisation
+}
+
+// DomainContext holds the data of a domain shared by domain collectors.
+type DomainContext struct {
+	Stat libvirt.DomainStats
+	Name string
+	UUID string
+	Desc libvirtSchema.Domain
+	// XMLDesc is the raw XML description of the domain.
+	XMLDesc string
+	// Incomplete is set if libvirt has skipped the stats that require a
+	// job on the domain, see domainStatsIncomplete.
+	Incomplete bool
+	// SampledAt is the time the stats were taken.
+	SampledAt time.Time
+	// Labels are the identity labels attached to the domain metrics.
+	Labels *LabelPolicy
+	// BlockDeviceTypes are the types of block devices whose stats are
+	// exported.
+	BlockDeviceTypes map[string]bool
+	// BlockDevices are the block devices from the stats matched to the
+	// domain XML.
+	BlockDevices []BlockDevice
+	// MemoryStatsPeriod is the balloon stats period set on the domain.
+	MemoryStatsPeriod MemoryStatsPeriodConfig
+	// CPUUtilisation computes the CPU utilisation of the domain, nil if it
+	// is disabled.
+	CPUUtilisation *CPUUtilisation
+	// ScrapeStats accounts libvirt calls made by collectors.
+	ScrapeStats *ScrapeStats
+}
+
+// NewDomainContext fetches the data of a domain needed by all collectors.
+// sampledAt is the time the stats were taken. It returns errDomainFiltered
+// if the domain is skipped by the filter of policy.
+func NewDomainContext(stat libvirt.DomainStats, sampledAt time.Time, policy *DomainPolicy, scrapeStats *ScrapeStats) (*DomainContext, error) {
 	domainName, err := stat.Domain.GetName()
 	if err != nil {
-		return err
+		return nil, &DomainError{Stage: "name", Err: err}
 	}
 
 	domainUUID, err := stat.Domain.GetUUIDString()
 	if err != nil {
-		return err
+		return nil, &DomainError{Domain: domainName, Stage: "uuid", Err: err}
+	}
+
+	// Filter by name, UUID and state first to skip the XML of the domains
+	// that are filtered out anyway
+	var state libvirt.DomainState
+	if stat.State != nil {
+		state = stat.State.State
+	}
+	keep, decided := policy.Filter.Keep(domainName, domainUUID, state, nil)
+	if decided && !keep {
+		return nil, errDomainFiltered
 	}
 
 	// Decode XML description of domain to get block device names, etc.
+	start := time.Now()
 	xmlDesc, err := stat.Domain.GetXMLDesc(0)
+	scrapeStats.ObserveCall("virDomainGetXMLDesc", start)
 	if err != nil {
-		return err
+		return nil, &DomainError{Domain: domainName, Stage: "xml", Err: err}
 	}
 	var desc libvirtSchema.Domain
 	err = xml.Unmarshal([]byte(xmlDesc), &desc)
+	if err != nil {
+		return nil, &DomainError{Domain: domainName, Stage: "xml", Err: err}
+	}
+	if !decided {
+		if keep, _ = policy.Filter.Keep(domainName, domainUUID, state, &desc); !keep {
+			return nil, errDomainFiltered
+		}
+	}
+
+	blockDevices, problems := MatchBlockDevices(stat.Block, desc.Devices.Disks)
+	for _, problem := range problems {
+		// Metadata of such devices is left empty, the rest of the domain
+		// metrics are still reported
+		scrapeStats.ObserveDomainError(&DomainError{Domain: domainName, Stage: "block_xml", Err: errors.New(problem)})
+	}
+
+	return &DomainContext{
+		Stat:              stat,
+		Name:              domainName,
+		UUID:              domainUUID,
+		Desc:              desc,
+		XMLDesc:           xmlDesc,
+		Incomplete:        domainStatsIncomplete(stat),
+		SampledAt:         sampledAt,
+		Labels:            policy.Labels,
+		BlockDeviceTypes:  policy.BlockDeviceTypes,
+		BlockDevices:      blockDevices,
+		MemoryStatsPeriod: policy.MemoryStatsPeriod,
+		CPUUtilisation:    policy.CPUUtilisation,
+		ScrapeStats:       scrapeStats,
+	}, nil
+}
+
+// CollectDomain extracts Prometheus metrics from a libvirt domain using
+// the given collectors. sampledAt is the time the stats were taken.
+func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats, sampledAt time.Time, collectors []*Collector, policy *DomainPolicy, scrapeStats *ScrapeStats) error {
+	domain, err := NewDomainContext(stat, sampledAt, policy, scrapeStats)
 	if err != nil {
 		return err
 	}
 
-	// Report domain info.
-	info, err := stat.Domain.GetInfo()
+	var incompleteValue float64
+	if domain.Incomplete {
+		incompleteValue = 1
+	}
+	ch <- domain.MustNewConstMetric(
+		libvirtDomainStatsIncompleteDesc,
+		prometheus.GaugeValue,
+		incompleteValue,
+		domain.Name)
+
+	if policy.CustomLabels != nil {
+		err = policy.CustomLabels.Collect(ch, domain)
+		if err != nil {
+			return &DomainError{Domain: domain.Name, Stage: "custom_labels", Err: err}
+		}
+	}
+
+	for _, collector := range collectors {
+		if collector.CollectDomain == nil {
+			continue
+		}
+		start := time.Now()
+		err = collector.CollectDomain(ch, domain)
+		scrapeStats.ObserveCollector(collector.Name, start, err)
+		if err != nil {
+			return &DomainError{Domain: domain.Name, Stage: collector.Name, Err: err}
+		}
+	}
+	return nil
+}
+
+// blockDeviceTypes lists the types of block devices known to libvirt.
+var blockDeviceTypes = []string{"disk", "cdrom", "floppy", "lun"}
+
+// DefaultBlockDeviceTypes are the types of block devices whose stats are
+// exported by default. Removable devices are skipped.
+var DefaultBlockDeviceTypes = []string{"disk", "lun"}
+
+// BlockDeviceTypes validates names of block device types and returns them
+// as a set.
+func BlockDeviceTypes(names []string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, known := range blockDeviceTypes {
+			if name == known {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown block device type %q", name)
+		}
+		types[name] = true
+	}
+	return types, nil
+}
+
+// BlockDevice is a block device from the domain stats along with its XML
+// description.
+type BlockDevice struct {
+	Stats libvirt.DomainStatsBlock
+	// Desc is nil if the device is missing from the domain XML, e.g. when
+	// it has been hot-plugged after the stats were taken.
+	Desc *libvirtSchema.Disk
+}
+
+// MatchBlockDevices matches block stats to the disks of the domain XML by
+// target name. Stats of backing chain images, which share the name of the
+// top image, are skipped, as they would duplicate its series. problems
+// describes the stats that have no single matching disk.
+func MatchBlockDevices(blocks []libvirt.DomainStatsBlock, disks []libvirtSchema.Disk) (devices []BlockDevice, problems []string) {
+	seen := make(map[string]bool)
+	for _, block := range blocks {
+		if !block.NameSet {
+			problems = append(problems, "block device without a name")
+			continue
+		}
+		if seen[block.Name] {
+			// Backing chain image, only reported if stats are requested
+			// with CONNECT_GET_ALL_DOMAINS_STATS_BACKING
+			continue
+		}
+		seen[block.Name] = true
+
+		device := BlockDevice{Stats: block}
+		matches := 0
+		for i := range disks {
+			if disks[i].Target.Device != block.Name {
+				continue
+			}
+			if matches == 0 {
+				device.Desc = &disks[i]
+			}
+			matches++
+		}
+		switch {
+		case matches == 0:
+			problems = append(problems, fmt.Sprintf("block device %s is missing from the domain XML", block.Name))
+		case matches > 1:
+			problems = append(problems, fmt.Sprintf("block device %s is found %d times in the domain XML", block.Name, matches))
+		}
+		devices = append(devices, device)
+	}
+	return devices, problems
+}
+
+// blockDeviceType returns the type of the block device, e.g. disk or cdrom.
+func blockDeviceType(dev *libvirtSchema.Disk) string {
+	if dev == nil || dev.Device == "" {
+		// The default in libvirt
+		return "disk"
+	}
+	return dev.Device
+}
+
+// removableMediaInserted reports whether a medium is inserted into the
+// removable block device.
+func removableMediaInserted(dev *libvirtSchema.Disk) bool {
+	source := dev.Source
+	return source.File != "" || source.Dev != "" || source.Name != "" || source.Volume != ""
+}
+
+// collectDomainInfo reports general domain info and metadata.
+func collectDomainInfo(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	start := time.Now()
+	info, err := domain.Stat.Domain.GetInfo()
+	domain.ScrapeStats.ObserveCall("virDomainGetInfo", start)
 	if err != nil {
 		return err
 	}
-	ch <- prometheus.MustNewConstMetric(
+	ch <- domain.MustNewConstMetric(
 		libvirtDomainInfoMetaDesc,
 		prometheus.GaugeValue,
 		float64(1),
-		domainName,
-		domainUUID,
-		desc.Metadata.NovaInstance.NovaName,
-		desc.Metadata.NovaInstance.NovaFlavor.FlavorName,
-		desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserName,
-		desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserUUID,
-		desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectName,
-		desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectUUID,
-		desc.Metadata.NovaInstance.NovaRoot.RootType,
-		desc.Metadata.NovaInstance.NovaRoot.RootUUID)
-	ch <- prometheus.MustNewConstMetric(
+		domain.Name,
+		domain.UUID,
+		domain.Desc.Metadata.NovaInstance.NovaName,
+		domain.Desc.Metadata.NovaInstance.NovaFlavor.FlavorName,
+		domain.Desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserName,
+		domain.Desc.Metadata.NovaInstance.NovaOwner.NovaUser.UserUUID,
+		domain.Desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectName,
+		domain.Desc.Metadata.NovaInstance.NovaOwner.NovaProject.ProjectUUID,
+		domain.Desc.Metadata.NovaInstance.NovaRoot.RootType,
+		domain.Desc.Metadata.NovaInstance.NovaRoot.RootUUID)
+	ch <- domain.MustNewConstMetric(
 		libvirtDomainInfoMaxMemBytesDesc,
 		prometheus.GaugeValue,
 		float64(info.MaxMem)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domain.Name)
+	ch <- domain.MustNewConstMetric(
 		libvirtDomainInfoMemoryUsageBytesDesc,
 		prometheus.GaugeValue,
 		float64(info.Memory)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domain.Name)
+	ch <- domain.MustNewConstMetric(
 		libvirtDomainInfoNrVirtCPUDesc,
 		prometheus.GaugeValue,
 		float64(info.NrVirtCpu),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domain.Name)
+	ch <- domain.MustNewConstMetric(
 		libvirtDomainInfoCPUTimeDesc,
 		prometheus.CounterValue,
 		float64(info.CpuTime)/1000/1000/1000, // From nsec to sec
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
+		domain.Name)
+	ch <- domain.MustNewConstMetric(
 		libvirtDomainInfoVirDomainState,
 		prometheus.GaugeValue,
 		float64(info.State),
-		domainName)
+		domain.Name)
+
+	if state := domain.Stat.State; state != nil && state.StateSet && state.ReasonSet {
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainStateReasonDesc,
+			prometheus.GaugeValue,
+			float64(state.Reason),
+			domain.Name,
+			domainStateName(state.State),
+			domainStateReasonName(state.State, state.Reason))
+	}
 
-	domainStatsVcpu, err := stat.Domain.GetVcpus()
+	return nil
+}
+
+// collectDomainVcpu reports per-vCPU statistics.
+func collectDomainVcpu(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	start := time.Now()
+	domainStatsVcpu, err := domain.Stat.Domain.GetVcpus()
+	domain.ScrapeStats.ObserveCall("virDomainGetVcpus", start)
 	if err != nil {
 		lverr, ok := err.(libvirt.Error)
 		if !ok || lverr.Code != libvirt.ERR_OPERATION_INVALID {
@@ -471,25 +1050,25 @@ func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats) error
 		}
 	} else {
 		for _, vcpu := range domainStatsVcpu {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainVcpuStateDesc,
 				prometheus.GaugeValue,
 				float64(vcpu.State),
-				domainName,
+				domain.Name,
 				strconv.FormatInt(int64(vcpu.Number), 10))
 
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainVcpuTimeDesc,
 				prometheus.CounterValue,
 				float64(vcpu.CpuTime)/1000/1000/1000, // From nsec to sec
-				domainName,
+				domain.Name,
 				strconv.FormatInt(int64(vcpu.Number), 10))
 
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainVcpuCPUDesc,
 				prometheus.GaugeValue,
 				float64(vcpu.Cpu),
-				domainName,
+				domain.Name,
 				strconv.FormatInt(int64(vcpu.Number), 10))
 		}
 		/* There's no Wait in GetVcpus()
@@ -497,56 +1076,84 @@ func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats) error
 		 * Time and State are present in both structs
 		 * So, let's take Wait here
 		 */
-		for cpuNum, vcpu := range stat.Vcpu {
+		for cpuNum, vcpu := range domain.Stat.Vcpu {
 			if vcpu.WaitSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainVcpuWaitDesc,
 					prometheus.CounterValue,
 					float64(vcpu.Wait)/1000/1000/1000,
-					domainName,
+					domain.Name,
 					strconv.FormatInt(int64(cpuNum), 10))
 			}
 			if vcpu.DelaySet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainVcpuDelayDesc,
 					prometheus.CounterValue,
 					float64(vcpu.Delay)/1e9,
-					domainName,
+					domain.Name,
 					strconv.FormatInt(int64(cpuNum), 10))
 			}
 		}
 	}
 
-	// Report block device statistics.
-	for _, disk := range stat.Block {
+	return nil
+}
+
+// collectDomainBlock reports block device statistics.
+func collectDomainBlock(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	for _, dev := range domain.Desc.Devices.Disks {
+		deviceType := blockDeviceType(&dev)
+		if deviceType != "cdrom" && deviceType != "floppy" {
+			continue
+		}
+		var inserted, trayOpen float64
+		if removableMediaInserted(&dev) {
+			inserted = 1
+		}
+		if dev.Target.Tray == "open" {
+			trayOpen = 1
+		}
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainBlockMediaInsertedDesc,
+			prometheus.GaugeValue,
+			inserted,
+			domain.Name,
+			dev.Target.Device,
+			deviceType)
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainBlockTrayOpenDesc,
+			prometheus.GaugeValue,
+			trayOpen,
+			domain.Name,
+			dev.Target.Device,
+			deviceType)
+	}
+
+	for _, blockDevice := range domain.BlockDevices {
 		var DiskSource string
-		var Device *libvirtSchema.Disk
-		// Ugly hack to avoid getting metrics from cdrom block device
-		// TODO: somehow check the disk 'device' field for 'cdrom' string
-		if disk.Name == "hdc" || disk.Name == "hda" {
+		disk := blockDevice.Stats
+		Device := blockDevice.Desc
+		deviceType := blockDeviceType(Device)
+		if !domain.BlockDeviceTypes[deviceType] {
 			continue
 		}
+		if Device == nil {
+			Device = &libvirtSchema.Disk{}
+		}
 		/*  "block.<num>.path" - string describing the source of block device <num>,
 		    if it is a file or block device (omitted for network
 		    sources and drives with no media inserted). For network device (i.e. rbd) take from xml. */
-		for _, dev := range desc.Devices.Disks {
-			if dev.Target.Device == disk.Name {
-				if disk.PathSet {
-					DiskSource = disk.Path
-
-				} else {
-					DiskSource = dev.Source.Name
-				}
-				Device = &dev
-				break
-			}
+		if disk.PathSet {
+			DiskSource = disk.Path
+		} else {
+			DiskSource = Device.Source.Name
 		}
 
-		ch <- prometheus.MustNewConstMetric(
+		ch <- domain.MustNewConstMetric(
 			libvirtDomainMetaBlockDesc,
 			prometheus.GaugeValue,
 			float64(1),
-			domainName,
+			domain.Name,
 			disk.Name,
 			DiskSource,
 			Device.Serial,
@@ -555,274 +1162,309 @@ func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats) error
 			Device.Driver.Type,
 			Device.Driver.Cache,
 			Device.Driver.Discard,
+			deviceType,
+			Device.Driver.IOThread,
 		)
 
 		// https://libvirt.org/html/libvirt-libvirt-domain.html#virConnectGetAllDomainStats
 		if disk.RdBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockRdBytesDesc,
 				prometheus.CounterValue,
 				float64(disk.RdBytes),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.RdReqsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockRdReqDesc,
 				prometheus.CounterValue,
 				float64(disk.RdReqs),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.RdTimesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockRdTotalTimeSecondsDesc,
 				prometheus.CounterValue,
 				float64(disk.RdTimes)/1e9,
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.WrBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockWrBytesDesc,
 				prometheus.CounterValue,
 				float64(disk.WrBytes),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.WrReqsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockWrReqDesc,
 				prometheus.CounterValue,
 				float64(disk.WrReqs),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.WrTimesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockWrTotalTimesDesc,
 				prometheus.CounterValue,
 				float64(disk.WrTimes)/1e9,
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.FlReqsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockFlushReqDesc,
 				prometheus.CounterValue,
 				float64(disk.FlReqs),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.FlTimesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockFlushTotalTimeSecondsDesc,
 				prometheus.CounterValue,
 				float64(disk.FlTimes)/1e9,
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.AllocationSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockAllocationDesc,
 				prometheus.GaugeValue,
 				float64(disk.Allocation),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.CapacitySet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockCapacityBytesDesc,
 				prometheus.GaugeValue,
 				float64(disk.Capacity),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
 		if disk.PhysicalSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainBlockPhysicalSizeBytesDesc,
 				prometheus.GaugeValue,
 				float64(disk.Physical),
-				domainName,
+				domain.Name,
 				disk.Name)
 		}
+	}
 
-		blockIOTuneParams, err := stat.Domain.GetBlockIoTune(disk.Name, 0)
+	return nil
+}
+
+// collectDomainBlkioTune reports block device IO tune parameters. Devices
+// missing from the domain XML and empty removable drives are skipped.
+func collectDomainBlkioTune(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	if domain.Incomplete {
+		// GetBlockIoTune would wait for the domain job
+		return nil
+	}
+	for _, blockDevice := range domain.BlockDevices {
+		disk := blockDevice.Stats
+		if blockDevice.Desc == nil {
+			// Unplugged after the stats were taken, GetBlockIoTune would
+			// fail to find it
+			continue
+		}
+		deviceType := blockDeviceType(blockDevice.Desc)
+		if !domain.BlockDeviceTypes[deviceType] {
+			continue
+		}
+		if (deviceType == "cdrom" || deviceType == "floppy") && !removableMediaInserted(blockDevice.Desc) {
+			// An empty drive has no IO tune parameters
+			continue
+		}
+		start := time.Now()
+		blockIOTuneParams, err := domain.Stat.Domain.GetBlockIoTune(disk.Name, 0)
+		domain.ScrapeStats.ObserveCall("virDomainGetBlockIoTune", start)
 		if err != nil {
 			lverr, ok := err.(libvirt.Error)
 			if !ok {
-				switch lverr.Code {
-				case libvirt.ERR_OPERATION_INVALID:
-					// This should be one-shot error
-					log.Printf("Invalid operation GetBlockIoTune: %s", err.Error())
-				case libvirt.ERR_OPERATION_UNSUPPORTED:
-					WriteErrorOnce("Unsupported operation GetBlockIoTune: "+err.Error(), "blkiotune_unsupported")
-				default:
-					return err
-				}
+				return err
+			}
+			switch lverr.Code {
+			case libvirt.ERR_OPERATION_INVALID:
+				// This should be one-shot error
+				log.Printf("Invalid operation GetBlockIoTune: %s", err.Error())
+			case libvirt.ERR_OPERATION_UNSUPPORTED:
+				WriteErrorOnce("Unsupported operation GetBlockIoTune: "+err.Error(), "blkiotune_unsupported")
+			default:
+				return err
 			}
 		} else {
 			if blockIOTuneParams.TotalBytesSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockTotalBytesSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalBytesSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.ReadBytesSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockReadBytesSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadBytesSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.WriteBytesSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockWriteBytesSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteBytesSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.TotalIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockTotalIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalIopsSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.ReadIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockReadIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadIopsSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.WriteIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockWriteIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteIopsSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.TotalBytesSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockTotalBytesSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalBytesSecMax),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.ReadBytesSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockReadBytesSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadBytesSecMax),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.WriteBytesSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockWriteBytesSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteBytesSecMax),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.TotalIopsSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockTotalIopsSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalIopsSecMax),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.ReadIopsSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockReadIopsSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadIopsSecMax),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.WriteIopsSecMaxSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockWriteIopsSecMaxDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteIopsSecMax),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.TotalBytesSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockTotalBytesSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalBytesSecMaxLength),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.ReadBytesSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockReadBytesSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadBytesSecMaxLength),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.WriteBytesSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockWriteBytesSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteBytesSecMaxLength),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.TotalIopsSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockTotalIopsSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.TotalIopsSecMaxLength),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.ReadIopsSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockReadIopsSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.ReadIopsSecMaxLength),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.WriteIopsSecMaxLengthSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockWriteIopsSecMaxLengthDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.WriteIopsSecMaxLength),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 			if blockIOTuneParams.SizeIopsSecSet {
-				ch <- prometheus.MustNewConstMetric(
+				ch <- domain.MustNewConstMetric(
 					libvirtDomainBlockSizeIopsSecDesc,
 					prometheus.GaugeValue,
 					float64(blockIOTuneParams.SizeIopsSec),
-					domainName,
+					domain.Name,
 					disk.Name)
 			}
 		}
 	}
 
-	// Report network interface statistics.
-	for _, iface := range stat.Net {
+	return nil
+}
+
+// collectDomainInterface reports network interface statistics.
+func collectDomainInterface(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	for _, iface := range domain.Stat.Net {
 		var SourceBridge string
 		var VirtualInterface string
 		// Additional info for ovs network
-		for _, net := range desc.Devices.Interfaces {
+		for _, net := range domain.Desc.Devices.Interfaces {
 			if net.Target.Device == iface.Name {
 				SourceBridge = net.Source.Bridge
 				VirtualInterface = net.Virtualport.Parameters.InterfaceID
@@ -830,145 +1472,221 @@ func CollectDomain(ch chan<- prometheus.Metric, stat libvirt.DomainStats) error
 			}
 		}
 		if SourceBridge != "" || VirtualInterface != "" {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainMetaInterfacesDesc,
 				prometheus.GaugeValue,
 				float64(1),
-				domainName,
+				domain.Name,
 				SourceBridge,
 				iface.Name,
 				VirtualInterface)
 		}
 		if iface.RxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceRxBytesDesc,
 				prometheus.CounterValue,
 				float64(iface.RxBytes),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.RxPktsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceRxPacketsDesc,
 				prometheus.CounterValue,
 				float64(iface.RxPkts),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.RxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceRxErrsDesc,
 				prometheus.CounterValue,
 				float64(iface.RxErrs),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.RxDropSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceRxDropDesc,
 				prometheus.CounterValue,
 				float64(iface.RxDrop),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.TxBytesSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceTxBytesDesc,
 				prometheus.CounterValue,
 				float64(iface.TxBytes),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.TxPktsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceTxPacketsDesc,
 				prometheus.CounterValue,
 				float64(iface.TxPkts),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.TxErrsSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceTxErrsDesc,
 				prometheus.CounterValue,
 				float64(iface.TxErrs),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 		if iface.TxDropSet {
-			ch <- prometheus.MustNewConstMetric(
+			ch <- domain.MustNewConstMetric(
 				libvirtDomainInterfaceTxDropDesc,
 				prometheus.CounterValue,
 				float64(iface.TxDrop),
-				domainName,
+				domain.Name,
 				iface.Name)
 		}
 	}
 
-	// Collect Memory Stats
-	memorystat, err := stat.Domain.MemoryStats(11, 0)
-	var MemoryStats libvirtSchema.VirDomainMemoryStats
-	var usedPercent float64
-	if err == nil {
-		MemoryStats = memoryStatCollect(&memorystat)
-		if MemoryStats.Usable != 0 && MemoryStats.Available != 0 {
-			usedPercent = (float64(MemoryStats.Available) - float64(MemoryStats.Usable)) / (float64(MemoryStats.Available) / float64(100))
-		}
+	return nil
+}
+
+// collectDomainMemory reports memory statistics of the domain from its
+// balloon stats. Only the stats reported by libvirt are exported, most of
+// them need the balloon driver in the guest.
+func collectDomainMemory(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	collectMemoryStatsPeriod(ch, domain)
 
+	balloon := domain.Stat.Balloon
+	var available float64
+	if guestMemoryStatsReported(balloon) {
+		available = 1
 	}
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatMajorFaultTotalDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.MajorFault),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatMinorFaultTotalDesc,
-		prometheus.CounterValue,
-		float64(MemoryStats.MinorFault),
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUnusedBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Unused)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatAvailableBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Available)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatActualBaloonBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.ActualBalloon)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatRssBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.Rss)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUsableBytesDesc,
+	ch <- domain.MustNewConstMetric(
+		libvirtDomainMemoryStatAvailableDesc,
 		prometheus.GaugeValue,
-		float64(MemoryStats.Usable)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatDiskCachesBytesDesc,
-		prometheus.GaugeValue,
-		float64(MemoryStats.DiskCaches)*1024,
-		domainName)
-	ch <- prometheus.MustNewConstMetric(
-		libvirtDomainMemoryStatUsedPercentDesc,
-		prometheus.GaugeValue,
-		float64(usedPercent),
-		domainName)
+		available,
+		domain.Name)
+	if balloon == nil {
+		return nil
+	}
+	for _, stat := range []struct {
+		set       bool
+		value     float64
+		desc      *prometheus.Desc
+		valueType prometheus.ValueType
+	}{
+		// Sizes are in KiB
+		{balloon.CurrentSet, float64(balloon.Current) * 1024, libvirtDomainMemoryStatActualBaloonBytesDesc, prometheus.GaugeValue},
+		{balloon.MaximumSet, float64(balloon.Maximum) * 1024, libvirtDomainMemoryStatMaximumBytesDesc, prometheus.GaugeValue},
+		{balloon.SwapInSet, float64(balloon.SwapIn) * 1024, libvirtDomainMemoryStatSwapInBytesDesc, prometheus.CounterValue},
+		{balloon.SwapOutSet, float64(balloon.SwapOut) * 1024, libvirtDomainMemoryStatSwapOutBytesDesc, prometheus.CounterValue},
+		{balloon.MajorFaultSet, float64(balloon.MajorFault), libvirtDomainMemoryStatMajorFaultTotalDesc, prometheus.CounterValue},
+		{balloon.MinorFaultSet, float64(balloon.MinorFault), libvirtDomainMemoryStatMinorFaultTotalDesc, prometheus.CounterValue},
+		{balloon.UnusedSet, float64(balloon.Unused) * 1024, libvirtDomainMemoryStatUnusedBytesDesc, prometheus.GaugeValue},
+		{balloon.AvailableSet, float64(balloon.Available) * 1024, libvirtDomainMemoryStatAvailableBytesDesc, prometheus.GaugeValue},
+		{balloon.RssSet, float64(balloon.Rss) * 1024, libvirtDomainMemoryStatRssBytesDesc, prometheus.GaugeValue},
+		{balloon.UsableSet, float64(balloon.Usable) * 1024, libvirtDomainMemoryStatUsableBytesDesc, prometheus.GaugeValue},
+		{balloon.LastUpdateSet, float64(balloon.LastUpdate), libvirtDomainMemoryStatLastUpdateDesc, prometheus.GaugeValue},
+		{balloon.DiskCachesSet, float64(balloon.DiskCaches) * 1024, libvirtDomainMemoryStatDiskCachesBytesDesc, prometheus.GaugeValue},
+		{balloon.HugetlbPgAllocSet, float64(balloon.HugetlbPgAlloc), libvirtDomainMemoryStatHugetlbPgAllocDesc, prometheus.CounterValue},
+		{balloon.HugetlbPgFailSet, float64(balloon.HugetlbPgFail), libvirtDomainMemoryStatHugetlbPgFailDesc, prometheus.CounterValue},
+	} {
+		if stat.set {
+			ch <- domain.MustNewConstMetric(stat.desc, stat.valueType, stat.value, domain.Name)
+		}
+	}
+
+	if balloon.AvailableSet && balloon.UsableSet && balloon.Available != 0 {
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainMemoryStatUsedPercentDesc,
+			prometheus.GaugeValue,
+			(float64(balloon.Available)-float64(balloon.Usable))/(float64(balloon.Available)/float64(100)),
+			domain.Name)
+	}
 
 	return nil
 }
 
+// guestMemoryStatsReported tells whether the balloon driver of the guest
+// reports its memory statistics. The current and maximum balloon size and
+// the RSS are known to the host anyway.
+func guestMemoryStatsReported(balloon *libvirt.DomainStatsBalloon) bool {
+	if balloon == nil {
+		return false
+	}
+	return balloon.SwapInSet || balloon.SwapOutSet || balloon.MajorFaultSet || balloon.MinorFaultSet ||
+		balloon.UnusedSet || balloon.AvailableSet || balloon.UsableSet || balloon.LastUpdateSet ||
+		balloon.DiskCachesSet || balloon.HugetlbPgAllocSet || balloon.HugetlbPgFailSet
+}
+
+// collectDomainPerf reports perf event counters of the domain. Only the
+// events enabled for the domain are reported.
+func collectDomainPerf(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	perf := domain.Stat.Perf
+	if perf == nil {
+		return nil
+	}
+	for _, event := range []struct {
+		set       bool
+		value     float64
+		desc      *prometheus.Desc
+		valueType prometheus.ValueType
+	}{
+		{perf.CmtSet, float64(perf.Cmt), libvirtDomainPerfCmtDesc, prometheus.GaugeValue},
+		{perf.MbmtSet, float64(perf.Mbmt), libvirtDomainPerfMbmtDesc, prometheus.GaugeValue},
+		{perf.MbmlSet, float64(perf.Mbml), libvirtDomainPerfMbmlDesc, prometheus.GaugeValue},
+		{perf.CacheMissesSet, float64(perf.CacheMisses), libvirtDomainPerfCacheMissesDesc, prometheus.CounterValue},
+		{perf.CacheReferencesSet, float64(perf.CacheReferences), libvirtDomainPerfCacheReferencesDesc, prometheus.CounterValue},
+		{perf.InstructionsSet, float64(perf.Instructions), libvirtDomainPerfInstructionsDesc, prometheus.CounterValue},
+		{perf.CpuCyclesSet, float64(perf.CpuCycles), libvirtDomainPerfCPUCyclesDesc, prometheus.CounterValue},
+		{perf.BranchInstructionsSet, float64(perf.BranchInstructions), libvirtDomainPerfBranchInstructionsDesc, prometheus.CounterValue},
+		{perf.BranchMissesSet, float64(perf.BranchMisses), libvirtDomainPerfBranchMissesDesc, prometheus.CounterValue},
+		{perf.BusCyclesSet, float64(perf.BusCycles), libvirtDomainPerfBusCyclesDesc, prometheus.CounterValue},
+		{perf.StalledCyclesFrontendSet, float64(perf.StalledCyclesFrontend), libvirtDomainPerfStalledCyclesFrontendDesc, prometheus.CounterValue},
+		{perf.StalledCyclesBackendSet, float64(perf.StalledCyclesBackend), libvirtDomainPerfStalledCyclesBackendDesc, prometheus.CounterValue},
+		{perf.RefCpuCyclesSet, float64(perf.RefCpuCycles), libvirtDomainPerfRefCPUCyclesDesc, prometheus.CounterValue},
+		{perf.CpuClockSet, float64(perf.CpuClock) / 1e9, libvirtDomainPerfCPUClockDesc, prometheus.CounterValue},
+		{perf.TaskClockSet, float64(perf.TaskClock) / 1e9, libvirtDomainPerfTaskClockDesc, prometheus.CounterValue},
+		{perf.PageFaultsSet, float64(perf.PageFaults), libvirtDomainPerfPageFaultsDesc, prometheus.CounterValue},
+		{perf.ContextSwitchesSet, float64(perf.ContextSwitches), libvirtDomainPerfContextSwitchesDesc, prometheus.CounterValue},
+		{perf.CpuMigrationsSet, float64(perf.CpuMigrations), libvirtDomainPerfCPUMigrationsDesc, prometheus.CounterValue},
+		{perf.PageFaultsMinSet, float64(perf.PageFaultsMin), libvirtDomainPerfPageFaultsMinDesc, prometheus.CounterValue},
+		{perf.PageFaultsMajSet, float64(perf.PageFaultsMaj), libvirtDomainPerfPageFaultsMajDesc, prometheus.CounterValue},
+		{perf.AlignmentFaultsSet, float64(perf.AlignmentFaults), libvirtDomainPerfAlignmentFaultsDesc, prometheus.CounterValue},
+		{perf.EmulationFaultsSet, float64(perf.EmulationFaults), libvirtDomainPerfEmulationFaultsDesc, prometheus.CounterValue},
+	} {
+		if event.set {
+			ch <- domain.MustNewConstMetric(event.desc, event.valueType, event.value, domain.Name)
+		}
+	}
+
+	return nil
+}
+
+// collectStoragePools reports stats of all active storage pools.
+func collectStoragePools(ch chan<- prometheus.Metric, conn *libvirt.Connect, scrapeStats *ScrapeStats) error {
+	start := time.Now()
+	pools, err := conn.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
+	scrapeStats.ObserveCall("virConnectListAllStoragePools", start)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		err = CollectStoragePool(ch, pool, scrapeStats)
+		pool.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Collect Storage pool stats
-func CollectStoragePool(ch chan<- prometheus.Metric, pool libvirt.StoragePool) error {
+func CollectStoragePool(ch chan<- prometheus.Metric, pool libvirt.StoragePool, scrapeStats *ScrapeStats) error {
 	// Refresh pool
+	start := time.Now()
 	err := pool.Refresh(0)
+	scrapeStats.ObserveCall("virStoragePoolRefresh", start)
 	if err != nil {
 		return err
 	}
@@ -976,7 +1694,9 @@ func CollectStoragePool(ch chan<- prometheus.Metric, pool libvirt.StoragePool) e
 	if err != nil {
 		return err
 	}
+	start = time.Now()
 	pool_info, err := pool.GetInfo()
+	scrapeStats.ObserveCall("virStoragePoolGetInfo", start)
 	if err != nil {
 		return err
 	}
@@ -999,30 +1719,87 @@ func CollectStoragePool(ch chan<- prometheus.Metric, pool libvirt.StoragePool) e
 	return nil
 }
 
-// CollectFromLibvirt obtains Prometheus metrics from all domains in a
-// libvirt setup.
-func CollectFromLibvirt(ch chan<- prometheus.Metric, uri string) error {
-	conn, err := libvirt.NewConnect(uri)
-	if err != nil {
-		return err
+// collectDomainBuffered runs CollectDomain and returns the collected
+// metrics, so that nothing is exported for a domain that has failed halfway.
+func collectDomainBuffered(stat libvirt.DomainStats, sampledAt time.Time, collectors []*Collector, policy *DomainPolicy, scrapeStats *ScrapeStats) ([]prometheus.Metric, error) {
+	metrics := make(chan prometheus.Metric)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- CollectDomain(metrics, stat, sampledAt, collectors, policy, scrapeStats)
+		close(metrics)
+	}()
+	var buf []prometheus.Metric
+	for metric := range metrics {
+		buf = append(buf, metric)
 	}
-	defer conn.Close()
+	return buf, <-errCh
+}
+
+// nowaitMinVersion is the first libvirt version supporting
+// CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT.
+const nowaitMinVersion = 4005000
+
+// domainResult holds the outcome of collecting a single domain.
+type domainResult struct {
+	metrics []prometheus.Metric
+	err     error
+}
 
+// collectDomains collects all domains using up to concurrency workers.
+// The result of every domain is sent as soon as it is collected, so that a
+// scrape that times out still reports the domains collected so far. The
+// returned channel is closed once all domains are collected.
+func collectDomains(stats []libvirt.DomainStats, sampledAt time.Time, collectors []*Collector, policy *DomainPolicy, concurrency int, scrapeStats *ScrapeStats) <-chan domainResult {
+	results := make(chan domainResult)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(stats); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				metrics, err := collectDomainBuffered(stats[i], sampledAt, collectors, policy, scrapeStats)
+				results <- domainResult{metrics: metrics, err: err}
+			}
+		}()
+	}
+	go func() {
+		for i := range stats {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// CollectFromLibvirt obtains Prometheus metrics from all domains in a
+// libvirt setup using the given collectors, collecting up to concurrency
+// domains in parallel. A domain that fails to be collected is skipped and
+// reported in the returned list of domain errors, the error is returned
+// only if the scrape as a whole has failed. The work done is accounted in
+// scrapeStats.
+func CollectFromLibvirt(ch chan<- prometheus.Metric, conn *libvirt.Connect, collectors []*Collector, policy *DomainPolicy, concurrency int, scrapeStats *ScrapeStats) ([]*DomainError, error) {
+	start := time.Now()
 	hypervisorVersionNum, err := conn.GetVersion() // virConnectGetVersion, hypervisor running, e.g. QEMU
+	scrapeStats.ObserveCall("virConnectGetVersion", start)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	hypervisorVersion := fmt.Sprintf("%d.%d.%d", hypervisorVersionNum/1000000%1000, hypervisorVersionNum/1000%1000, hypervisorVersionNum%1000)
 
+	start = time.Now()
 	libvirtdVersionNum, err := conn.GetLibVersion() // virConnectGetLibVersion, libvirt daemon running
+	scrapeStats.ObserveCall("virConnectGetLibVersion", start)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	libvirtdVersion := fmt.Sprintf("%d.%d.%d", libvirtdVersionNum/1000000%1000, libvirtdVersionNum/1000%1000, libvirtdVersionNum%1000)
 
 	libraryVersionNum, err := libvirt.GetVersion() // virGetVersion, version of libvirt (dynamic) library used by this binary (exporter), not the daemon version
 	if err != nil {
-		return err
+		return nil, err
 	}
 	libraryVersion := fmt.Sprintf("%d.%d.%d", libraryVersionNum/1000000%1000, libraryVersionNum/1000%1000, libraryVersionNum%1000)
 
@@ -1034,76 +1811,177 @@ func CollectFromLibvirt(ch chan<- prometheus.Metric, uri string) error {
 		libvirtdVersion,
 		libraryVersion)
 
-	stats, err := conn.GetAllDomainStats([]*libvirt.Domain{}, libvirt.DOMAIN_STATS_STATE|libvirt.DOMAIN_STATS_CPU_TOTAL|
-		libvirt.DOMAIN_STATS_INTERFACE|libvirt.DOMAIN_STATS_BALLOON|libvirt.DOMAIN_STATS_BLOCK|
-		libvirt.DOMAIN_STATS_PERF|libvirt.DOMAIN_STATS_VCPU,
-		//libvirt.CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT, // maybe in future
-		libvirt.CONNECT_GET_ALL_DOMAINS_STATS_RUNNING|libvirt.CONNECT_GET_ALL_DOMAINS_STATS_SHUTOFF)
+	statsFlags := libvirt.CONNECT_GET_ALL_DOMAINS_STATS_RUNNING | libvirt.CONNECT_GET_ALL_DOMAINS_STATS_SHUTOFF
+	if libvirtdVersionNum >= nowaitMinVersion && libraryVersionNum >= nowaitMinVersion {
+		// Do not wait for domains whose job is busy, report what is available instead
+		statsFlags |= libvirt.CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT
+	}
+	// Balloon stats are needed by domainStatsIncomplete, which keeps
+	// collectors from calling into domains with a busy job
+	statsTypes := libvirt.DOMAIN_STATS_STATE | libvirt.DOMAIN_STATS_BALLOON
+	for _, collector := range collectors {
+		statsTypes |= collector.StatsTypes
+	}
+	start = time.Now()
+	stats, err := conn.GetAllDomainStats([]*libvirt.Domain{}, statsTypes, statsFlags)
+	// Rates are computed against the time the stats were taken, not the
+	// time every domain is collected by the workers
+	sampledAt := time.Now()
+	scrapeStats.ObserveCall("virConnectGetAllDomainStats", start)
 	defer func(stats []libvirt.DomainStats) {
 		for _, stat := range stats {
 			stat.Domain.Free()
 		}
 	}(stats)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, stat := range stats {
-		err = CollectDomain(ch, stat)
+	var domainErrors []*DomainError
+	for result := range collectDomains(stats, sampledAt, collectors, policy, concurrency, scrapeStats) {
+		metrics, err := result.metrics, result.err
+		if err == errDomainFiltered {
+			scrapeStats.ObserveFiltered()
+			continue
+		}
 		if err != nil {
-			log.Printf("Failed to scrape metrics: %s", err)
+			log.Printf("Failed to scrape domain metrics: %s", err)
+			domainErr, ok := err.(*DomainError)
+			if !ok {
+				domainErr = &DomainError{Stage: "unknown", Err: err}
+			}
+			domainErrors = append(domainErrors, domainErr)
+			continue
+		}
+		for _, metric := range metrics {
+			ch <- metric
 		}
 	}
 
-	// Collect pool info
-	pools, err := conn.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
-	if err != nil {
-		return err
-	}
-	for _, pool := range pools {
-		err = CollectStoragePool(ch, pool)
-		pool.Free()
+	for _, collector := range collectors {
+		if collector.CollectConnection == nil {
+			continue
+		}
+		start = time.Now()
+		err = collector.CollectConnection(ch, conn, scrapeStats)
+		scrapeStats.ObserveCollector(collector.Name, start, err)
 		if err != nil {
-			return err
+			return domainErrors, err
 		}
 	}
-	return nil
+	return domainErrors, nil
 }
 
-func memoryStatCollect(memorystat *[]libvirt.DomainMemoryStat) libvirtSchema.VirDomainMemoryStats {
-	var MemoryStats libvirtSchema.VirDomainMemoryStats
-	for _, domainmemorystat := range *memorystat {
-		switch tag := domainmemorystat.Tag; tag {
-		case 2:
-			MemoryStats.MajorFault = domainmemorystat.Val
-		case 3:
-			MemoryStats.MinorFault = domainmemorystat.Val
-		case 4:
-			MemoryStats.Unused = domainmemorystat.Val
-		case 5:
-			MemoryStats.Available = domainmemorystat.Val
-		case 6:
-			MemoryStats.ActualBalloon = domainmemorystat.Val
-		case 7:
-			MemoryStats.Rss = domainmemorystat.Val
-		case 8:
-			MemoryStats.Usable = domainmemorystat.Val
-		case 10:
-			MemoryStats.DiskCaches = domainmemorystat.Val
-		}
-	}
-	return MemoryStats
+// domainErrorKey identifies a libvirt_domain_scrape_errors_total series.
+type domainErrorKey struct {
+	domain string
+	stage  string
+}
+
+// ExporterOptions tunes the way LibvirtExporter collects metrics.
+type ExporterOptions struct {
+	// Concurrency is the number of domains collected in parallel.
+	Concurrency int
+	// Timeout limits the duration of a scrape, zero means no limit.
+	// It is lowered to the timeout requested by Prometheus minus
+	// TimeoutOffset.
+	Timeout       time.Duration
+	TimeoutOffset time.Duration
+	// PollInterval enables collecting metrics in background at the given
+	// interval. Scrapes are then served from the last collected snapshot.
+	PollInterval time.Duration
+	// Collectors lists names of the enabled collectors.
+	Collectors []string
+	// DomainFilter selects domains to collect, all by default.
+	DomainFilter DomainFilterConfig
+	// DomainLabels are names of the identity labels attached to domain
+	// metrics, see identityLabels.
+	DomainLabels []string
+	// CustomLabels are the labels of libvirt_domain_info_custom.
+	CustomLabels CustomLabelsConfig
+	// BlockDeviceTypes are the types of block devices whose stats are
+	// exported, see blockDeviceTypes.
+	BlockDeviceTypes []string
+	// MemoryStatsPeriod is the balloon stats period set on domains.
+	MemoryStatsPeriod MemoryStatsPeriodConfig
+	// CPUUtilisation enables libvirt_domain_cpu_utilisation_ratio computed
+	// between collections.
+	CPUUtilisation bool
 }
 
 // LibvirtExporter implements a Prometheus exporter for libvirt state.
 type LibvirtExporter struct {
-	uri string
+	conn       *LibvirtConnection
+	opts       ExporterOptions
+	collectors []*Collector
+	policy     *DomainPolicy
+
+	mu              sync.Mutex
+	domainErrors    map[domainErrorKey]uint64
+	domainsFiltered uint64
+	lastPartial     bool
+	current         *scrape // the running or the last finished scrape
+	snapshot        *scrape // the last finished scrape, in polling mode
+	stop            chan struct{}
 }
 
 // NewLibvirtExporter creates a new Prometheus exporter for libvirt.
-func NewLibvirtExporter(uri string) (*LibvirtExporter, error) {
-	return &LibvirtExporter{
-		uri: uri,
-	}, nil
+func NewLibvirtExporter(uri string, opts ExporterOptions) (*LibvirtExporter, error) {
+	if opts.Concurrency < 1 {
+		return nil, fmt.Errorf("collector concurrency must be positive, got %d", opts.Concurrency)
+	}
+	collectors, err := LookupCollectors(opts.Collectors)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := NewDomainFilter(opts.DomainFilter)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := NewLabelPolicy(opts.DomainLabels)
+	if err != nil {
+		return nil, err
+	}
+	customLabels, err := NewCustomLabels(opts.CustomLabels, labels)
+	if err != nil {
+		return nil, err
+	}
+	deviceTypes, err := BlockDeviceTypes(opts.BlockDeviceTypes)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.MemoryStatsPeriod.validate(); err != nil {
+		return nil, err
+	}
+	var cpuUtilisation *CPUUtilisation
+	if opts.CPUUtilisation {
+		cpuUtilisation = NewCPUUtilisation()
+	}
+	e := &LibvirtExporter{
+		conn:       NewLibvirtConnection(uri),
+		opts:       opts,
+		collectors: collectors,
+		policy: &DomainPolicy{
+			Filter:            filter,
+			Labels:            labels,
+			CustomLabels:      customLabels,
+			BlockDeviceTypes:  deviceTypes,
+			MemoryStatsPeriod: opts.MemoryStatsPeriod,
+			CPUUtilisation:    cpuUtilisation,
+		},
+		domainErrors: make(map[domainErrorKey]uint64),
+		stop:         make(chan struct{}),
+	}
+	if opts.PollInterval > 0 {
+		go e.poll()
+	}
+	return e, nil
+}
+
+// Close stops polling and releases the connection to libvirt. A scrape
+// that is still running keeps its own reference to the connection.
+func (e *LibvirtExporter) Close() {
+	close(e.stop)
+	e.conn.Close()
 }
 
 // Describe returns metadata for all Prometheus metrics that may be exported.
@@ -1111,66 +1989,60 @@ func (e *LibvirtExporter) Describe(ch chan<- *prometheus.Desc) {
 	// Status and versions
 	ch <- libvirtUpDesc
 	ch <- libvirtVersionsInfoDesc
+	ch <- libvirtLastScrapePartialDesc
+	ch <- libvirtDomainScrapeErrorsDesc
+	ch <- libvirtDomainsFilteredDesc
+	ch <- libvirtSnapshotAgeDesc
+	ch <- libvirtScrapeCollectorDurationDesc
+	ch <- libvirtScrapeCollectorSuccessDesc
+	ch <- libvirtScrapeCallsDesc
+	ch <- libvirtScrapeCallsDurationDesc
+
+	// Connection state
+	ch <- libvirtConnectionUpDesc
+	ch <- libvirtConnectionReconnectsDesc
+	ch <- libvirtConnectionFailuresDesc
 
-	// Pool info
-	ch <- libvirtPoolInfoCapacity
-	ch <- libvirtPoolInfoAllocation
-	ch <- libvirtPoolInfoAvailable
-
-	// Domain info
-	ch <- libvirtDomainInfoMetaDesc
-	ch <- libvirtDomainInfoMaxMemBytesDesc
-	ch <- libvirtDomainInfoMemoryUsageBytesDesc
-	ch <- libvirtDomainInfoNrVirtCPUDesc
-	ch <- libvirtDomainInfoCPUTimeDesc
-	ch <- libvirtDomainInfoVirDomainState
-
-	// VCPU info
-	ch <- libvirtDomainVcpuStateDesc
-	ch <- libvirtDomainVcpuTimeDesc
-	ch <- libvirtDomainVcpuDelayDesc
-	ch <- libvirtDomainVcpuCPUDesc
-	ch <- libvirtDomainVcpuWaitDesc
-
-	// Domain block stats
-	ch <- libvirtDomainMetaBlockDesc
-	ch <- libvirtDomainBlockRdBytesDesc
-	ch <- libvirtDomainBlockRdReqDesc
-	ch <- libvirtDomainBlockRdTotalTimeSecondsDesc
-	ch <- libvirtDomainBlockWrBytesDesc
-	ch <- libvirtDomainBlockWrReqDesc
-	ch <- libvirtDomainBlockWrTotalTimesDesc
-	ch <- libvirtDomainBlockFlushReqDesc
-	ch <- libvirtDomainBlockFlushTotalTimeSecondsDesc
-	ch <- libvirtDomainBlockAllocationDesc
-	ch <- libvirtDomainBlockCapacityBytesDesc
-	ch <- libvirtDomainBlockPhysicalSizeBytesDesc
-
-	// Domain net interfaces stats
-	ch <- libvirtDomainMetaInterfacesDesc
-	ch <- libvirtDomainInterfaceRxBytesDesc
-	ch <- libvirtDomainInterfaceRxPacketsDesc
-	ch <- libvirtDomainInterfaceRxErrsDesc
-	ch <- libvirtDomainInterfaceRxDropDesc
-	ch <- libvirtDomainInterfaceTxBytesDesc
-	ch <- libvirtDomainInterfaceTxPacketsDesc
-	ch <- libvirtDomainInterfaceTxErrsDesc
-	ch <- libvirtDomainInterfaceTxDropDesc
-
-	// Domain memory stats
-	ch <- libvirtDomainMemoryStatMajorFaultTotalDesc
-	ch <- libvirtDomainMemoryStatMinorFaultTotalDesc
-	ch <- libvirtDomainMemoryStatUnusedBytesDesc
-	ch <- libvirtDomainMemoryStatAvailableBytesDesc
-	ch <- libvirtDomainMemoryStatActualBaloonBytesDesc
-	ch <- libvirtDomainMemoryStatRssBytesDesc
-	ch <- libvirtDomainMemoryStatUsableBytesDesc
-	ch <- libvirtDomainMemoryStatDiskCachesBytesDesc
+	// Domain state
+	ch <- e.policy.Labels.Desc(libvirtDomainStatsIncompleteDesc)
+	if e.policy.CustomLabels != nil {
+		ch <- e.policy.Labels.Desc(e.policy.CustomLabels.Desc())
+	}
+
+	// Metrics of the enabled collectors
+	for _, collector := range e.collectors {
+		for _, desc := range collector.Descs {
+			ch <- e.policy.Labels.Desc(desc)
+		}
+	}
 }
 
 // Collect scrapes Prometheus metrics from libvirt.
 func (e *LibvirtExporter) Collect(ch chan<- prometheus.Metric) {
-	err := CollectFromLibvirt(ch, e.uri)
+	e.collectWithTimeout(ch, e.opts.Timeout)
+}
+
+// collectWithTimeout scrapes Prometheus metrics from libvirt, giving up
+// after timeout unless it is zero. In polling mode the last snapshot is
+// served instead.
+func (e *LibvirtExporter) collectWithTimeout(ch chan<- prometheus.Metric, timeout time.Duration) {
+	s := e.lastSnapshot()
+	if s == nil {
+		s = e.startScrape()
+	}
+	metrics, err := s.Wait(timeout)
+	for _, metric := range metrics {
+		ch <- metric
+	}
+	if e.opts.PollInterval > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			libvirtSnapshotAgeDesc,
+			prometheus.GaugeValue,
+			s.Age().Seconds())
+	}
+
+	e.collectDomainCounters(ch)
+	e.conn.Collect(ch)
 	if err == nil {
 		ch <- prometheus.MustNewConstMetric(
 			libvirtUpDesc,
@@ -1185,24 +2057,216 @@ func (e *LibvirtExporter) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
+// startScrape starts collecting metrics from libvirt, unless a scrape is
+// already running, in which case the running one is returned.
+func (e *LibvirtExporter) startScrape() *scrape {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current == nil || e.current.Finished() {
+		e.current = startScrape(e.collect)
+	}
+	return e.current
+}
+
+// lastSnapshot returns the last finished scrape in polling mode, or nil.
+func (e *LibvirtExporter) lastSnapshot() *scrape {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.snapshot
+}
+
+// poll collects metrics every PollInterval and keeps the result as the
+// snapshot served by Collect.
+func (e *LibvirtExporter) poll() {
+	ticker := time.NewTicker(e.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		s := e.startScrape()
+		<-s.done
+		e.mu.Lock()
+		e.snapshot = s
+		e.mu.Unlock()
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *LibvirtExporter) collect(ch chan<- prometheus.Metric) error {
+	conn, err := e.conn.Get()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	scrapeStats := NewScrapeStats()
+	domainErrors, err := CollectFromLibvirt(ch, conn, e.collectors, e.policy, e.opts.Concurrency, scrapeStats)
+	if err != nil {
+		e.conn.Invalidate(conn)
+	}
+	if e.policy.CPUUtilisation != nil {
+		e.policy.CPUUtilisation.Prune(start)
+	}
+	scrapeStats.Collect(ch)
+	e.countDomains(domainErrors, scrapeStats)
+	return err
+}
+
+// countDomains accounts failed and filtered domains of a finished scrape.
+// Errors observed by scrapeStats have not prevented the domain from being
+// reported, so they do not make the scrape partial.
+func (e *LibvirtExporter) countDomains(domainErrors []*DomainError, scrapeStats *ScrapeStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.domainsFiltered += uint64(scrapeStats.Filtered())
+	for _, domainErr := range append(domainErrors, scrapeStats.DomainErrors()...) {
+		e.domainErrors[domainErrorKey{domainErr.Domain, domainErr.Stage}]++
+	}
+	e.lastPartial = len(domainErrors) > 0
+}
+
+// collectDomainCounters reports the per-domain error and filter counters.
+func (e *LibvirtExporter) collectDomainCounters(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for key, count := range e.domainErrors {
+		ch <- prometheus.MustNewConstMetric(
+			libvirtDomainScrapeErrorsDesc,
+			prometheus.CounterValue,
+			float64(count),
+			key.domain,
+			key.stage)
+	}
+	var partial float64
+	if e.lastPartial {
+		partial = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		libvirtLastScrapePartialDesc,
+		prometheus.GaugeValue,
+		partial)
+	ch <- prometheus.MustNewConstMetric(
+		libvirtDomainsFilteredDesc,
+		prometheus.CounterValue,
+		float64(e.domainsFiltered))
+}
+
+// scrapeCollector collects metrics of the exporter for a single scrape
+// limited by timeout.
+type scrapeCollector struct {
+	exporter *LibvirtExporter
+	timeout  time.Duration
+}
+
+func (c *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collectWithTimeout(ch, c.timeout)
+}
+
+// scrapeTimeout returns the time limit for the scrape requested by r.
+func (e *LibvirtExporter) scrapeTimeout(r *http.Request) time.Duration {
+	timeout := e.opts.Timeout
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		seconds, err := strconv.ParseFloat(header, 64)
+		if err != nil {
+			log.Printf("Failed to parse scrape timeout %q: %s", header, err)
+			return timeout
+		}
+		requested := time.Duration(seconds*float64(time.Second)) - e.opts.TimeoutOffset
+		if requested > 0 && (timeout == 0 || requested < timeout) {
+			timeout = requested
+		}
+	}
+	return timeout
+}
+
 func main() {
 	var (
 		app           = kingpin.New("libvirt_exporter", "Prometheus metrics exporter for libvirt")
+		configFile    = app.Flag("config.file", "Path to YAML configuration file, reloaded on SIGHUP or POST to /-/reload.").String()
 		listenAddress = app.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9177").String()
 		metricsPath   = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		libvirtURI    = app.Flag("libvirt.uri", "Libvirt URI from which to extract metrics.").Default("qemu:///system").String()
+		libvirtURIs   = app.Flag("libvirt.uri", "Libvirt URI from which to extract metrics, may be repeated.").Default("qemu:///system").Strings()
+		labelName     = app.Flag("libvirt.connection-label", "Label telling metrics of different libvirt URIs apart, added if more than one URI is set.").Default("connection").String()
+		domainLabels  = app.Flag("domain.label", "Identity label attached to every domain metric, may be repeated: name, uuid, nova_instance_name, nova_project_uuid or title.").Default(DefaultDomainLabels...).Strings()
+		deviceTypes   = app.Flag("collector.block.device-type", "Type of block devices whose stats are exported, may be repeated: disk, cdrom, floppy or lun.").Default(DefaultBlockDeviceTypes...).Strings()
+		statsPeriod   = app.Flag("collector.memory.stats-period", "Balloon stats period set on running domains having another period, 0 leaves domains unchanged. Only the live domain is changed.").Default("0s").Duration()
+		statsDryRun   = app.Flag("collector.memory.stats-period-dry-run", "Only report the domains whose balloon stats period would be changed.").Bool()
+		cpuUtil       = app.Flag("collector.cpu.utilisation", "Report CPU utilisation of domains normalised to vCPUs, computed between collections.").Bool()
+		probePath     = app.Flag("web.probe-path", "Path under which to expose metrics of probed libvirt URIs.").Default("/probe").String()
+		probeTargets  = app.Flag("probe.allowed-target", "Libvirt URI allowed to be probed, may be repeated.").Strings()
+		concurrency   = app.Flag("collector.concurrency", "Number of domains to collect in parallel.").Default("4").Int()
+		timeout       = app.Flag("collector.timeout", "Maximum duration of a scrape, 0 means no limit. Lowered to the timeout requested by Prometheus.").Default("0s").Duration()
+		timeoutOffset = app.Flag("collector.timeout-offset", "Offset to subtract from the timeout requested by Prometheus.").Default("0.5s").Duration()
+		pollInterval  = app.Flag("collector.poll-interval", "Collect metrics in background at this interval and serve the last snapshot on scrape, 0 disables polling.").Default("0s").Duration()
 	)
+	enabledCollectors := CollectorFlags(app)
 	app.Version(Version)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	errorsMap = make(map[string]struct{})
 
-	exporter, err := NewLibvirtExporter(*libvirtURI)
+	err := StartEventLoop()
+	if err != nil {
+		panic(err)
+	}
+
+	base := Config{
+		ConnectionLabel:  *labelName,
+		Collectors:       enabledCollectors(),
+		DomainLabels:     *domainLabels,
+		BlockDeviceTypes: *deviceTypes,
+		MemoryStatsPeriod: MemoryStatsPeriodConfig{
+			Period: *statsPeriod,
+			DryRun: *statsDryRun,
+		},
+		CPUUtilisation: *cpuUtil,
+		Probe: ProbeConfig{
+			AllowedTargets: *probeTargets,
+		},
+	}
+	seen := make(map[string]struct{})
+	for _, uri := range *libvirtURIs {
+		if _, ok := seen[uri]; !ok {
+			seen[uri] = struct{}{}
+			base.Connections = append(base.Connections, ConnectionConfig{URI: uri})
+		}
+	}
+	opts := ExporterOptions{
+		Concurrency:   *concurrency,
+		Timeout:       *timeout,
+		TimeoutOffset: *timeoutOffset,
+		PollInterval:  *pollInterval,
+	}
+	prometheus.MustRegister(configLastReloadSuccessful, configLastReloadSuccessTimestamp)
+	exporters, err := NewExporterSet(*configFile, base, opts)
 	if err != nil {
 		panic(err)
 	}
-	prometheus.MustRegister(exporter)
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := exporters.Reload(); err != nil {
+				log.Printf("Failed to reload configuration: %s", err)
+				continue
+			}
+			log.Printf("Configuration reloaded")
+		}
+	}()
+
+	http.Handle(*metricsPath, exporters.MetricsHandler())
+	http.Handle(*probePath, exporters.ProbeHandler())
+	http.Handle("/-/reload", exporters.ReloadHandler())
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`
 			<html>
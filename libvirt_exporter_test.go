@@ -0,0 +1,288 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Tinkoff/libvirt-exporter/libvirtSchema"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"libvirt.org/go/libvirt"
+)
+
+type testMetric struct {
+	value   float64
+	counter bool
+}
+
+// collectTestMetrics runs a domain collector and returns the reported
+// metrics by desc. The domain label must be the only label.
+func collectTestMetrics(t *testing.T, collect func(chan<- prometheus.Metric, *DomainContext) error, domain *DomainContext) map[*prometheus.Desc]testMetric {
+	ch := make(chan prometheus.Metric, 100)
+	if err := collect(ch, domain); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+
+	metrics := make(map[*prometheus.Desc]testMetric)
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Label) != 1 || m.Label[0].GetName() != "domain" || m.Label[0].GetValue() != domain.Name {
+			t.Errorf("%s: unexpected labels %v", metric.Desc(), m.Label)
+		}
+		if _, ok := metrics[metric.Desc()]; ok {
+			t.Errorf("%s: reported twice", metric.Desc())
+		}
+		switch {
+		case m.Counter != nil:
+			metrics[metric.Desc()] = testMetric{value: m.Counter.GetValue(), counter: true}
+		case m.Gauge != nil:
+			metrics[metric.Desc()] = testMetric{value: m.Gauge.GetValue()}
+		default:
+			t.Errorf("%s: unexpected type", metric.Desc())
+		}
+	}
+	return metrics
+}
+
+func checkTestMetrics(t *testing.T, got, want map[*prometheus.Desc]testMetric) {
+	for desc, metric := range want {
+		if got[desc] != metric {
+			t.Errorf("%s: got %+v, want %+v", desc, got[desc], metric)
+		}
+	}
+	for desc := range got {
+		if _, ok := want[desc]; !ok {
+			t.Errorf("%s: unexpected metric", desc)
+		}
+	}
+}
+
+func testDomainContext(stat libvirt.DomainStats) *DomainContext {
+	return &DomainContext{
+		Stat:        stat,
+		Name:        "instance-00000001",
+		Labels:      &LabelPolicy{},
+		ScrapeStats: NewScrapeStats(),
+	}
+}
+
+func testBlock(name, path string) libvirt.DomainStatsBlock {
+	return libvirt.DomainStatsBlock{NameSet: name != "", Name: name, PathSet: path != "", Path: path}
+}
+
+func testDisk(target, device string) libvirtSchema.Disk {
+	return libvirtSchema.Disk{Device: device, Target: libvirtSchema.DiskTarget{Device: target}}
+}
+
+func TestMatchBlockDevices(t *testing.T) {
+	disks := []libvirtSchema.Disk{
+		testDisk("vda", "disk"),
+		testDisk("sda", "cdrom"),
+		testDisk("vdb", "disk"),
+		testDisk("vdb", "lun"),
+	}
+	for _, test := range []struct {
+		name     string
+		blocks   []libvirt.DomainStatsBlock
+		devices  []string // target and device of the matched disk, "" if none
+		problems []string
+	}{
+		{
+			name:    "matched",
+			blocks:  []libvirt.DomainStatsBlock{testBlock("vda", "/images/vda.qcow2"), testBlock("sda", "")},
+			devices: []string{"vda disk", "sda cdrom"},
+		},
+		{
+			name:     "missing disk",
+			blocks:   []libvirt.DomainStatsBlock{testBlock("vdc", "/images/vdc.qcow2"), testBlock("vda", "/images/vda.qcow2")},
+			devices:  []string{"", "vda disk"},
+			problems: []string{"block device vdc is missing from the domain XML"},
+		},
+		{
+			name:     "duplicate target",
+			blocks:   []libvirt.DomainStatsBlock{testBlock("vdb", "/images/vdb.qcow2")},
+			devices:  []string{"vdb disk"},
+			problems: []string{"block device vdb is found 2 times in the domain XML"},
+		},
+		{
+			name:     "unnamed block",
+			blocks:   []libvirt.DomainStatsBlock{testBlock("", "/images/unknown.qcow2"), testBlock("vda", "/images/vda.qcow2")},
+			devices:  []string{"vda disk"},
+			problems: []string{"block device without a name"},
+		},
+		{
+			name: "backing chain",
+			blocks: []libvirt.DomainStatsBlock{
+				testBlock("vda", "/images/vda.qcow2"),
+				testBlock("vda", "/images/base.qcow2"),
+				testBlock("sda", ""),
+			},
+			devices: []string{"vda disk", "sda cdrom"},
+		},
+		{
+			name: "no blocks",
+		},
+	} {
+		devices, problems := MatchBlockDevices(test.blocks, disks)
+		var got []string
+		for _, device := range devices {
+			if device.Desc == nil {
+				got = append(got, "")
+			} else {
+				got = append(got, device.Desc.Target.Device+" "+device.Desc.Device)
+			}
+		}
+		if !reflect.DeepEqual(got, test.devices) {
+			t.Errorf("%s: got devices %q, want %q", test.name, got, test.devices)
+		}
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: got problems %q, want %q", test.name, problems, test.problems)
+		}
+		// Stats of the top image are kept
+		for i, device := range devices {
+			if device.Stats.Name == "vda" && device.Stats.Path != "/images/vda.qcow2" {
+				t.Errorf("%s: device %d has stats of %s", test.name, i, device.Stats.Path)
+			}
+		}
+	}
+}
+
+func TestCollectDomainPerf(t *testing.T) {
+	domain := testDomainContext(libvirt.DomainStats{})
+	if metrics := collectTestMetrics(t, collectDomainPerf, domain); len(metrics) != 0 {
+		t.Errorf("got %d metrics without perf stats", len(metrics))
+	}
+
+	domain = testDomainContext(libvirt.DomainStats{Perf: &libvirt.DomainStatsPerf{
+		CmtSet:           true,
+		Cmt:              4194304,
+		MbmtSet:          true,
+		Mbmt:             1048576,
+		CpuCyclesSet:     true,
+		CpuCycles:        123456789,
+		CpuClockSet:      true,
+		CpuClock:         2500000000, // nsec
+		TaskClockSet:     true,
+		TaskClock:        0,
+		PageFaultsMajSet: true,
+		PageFaultsMaj:    42,
+		// Events not enabled on the domain
+		CpuMigrations: 7,
+		Instructions:  1000,
+	}})
+	checkTestMetrics(t, collectTestMetrics(t, collectDomainPerf, domain), map[*prometheus.Desc]testMetric{
+		libvirtDomainPerfCmtDesc:           {value: 4194304},
+		libvirtDomainPerfMbmtDesc:          {value: 1048576},
+		libvirtDomainPerfCPUCyclesDesc:     {value: 123456789, counter: true},
+		libvirtDomainPerfCPUClockDesc:      {value: 2.5, counter: true},
+		libvirtDomainPerfTaskClockDesc:     {value: 0, counter: true},
+		libvirtDomainPerfPageFaultsMajDesc: {value: 42, counter: true},
+	})
+}
+
+func TestCollectDomainMemory(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		balloon *libvirt.DomainStatsBalloon
+		want    map[*prometheus.Desc]testMetric
+	}{
+		{
+			name: "no balloon stats",
+			want: map[*prometheus.Desc]testMetric{
+				libvirtDomainMemoryStatAvailableDesc: {value: 0},
+			},
+		},
+		{
+			name: "host stats only",
+			balloon: &libvirt.DomainStatsBalloon{
+				CurrentSet: true,
+				Current:    2097152,
+				MaximumSet: true,
+				Maximum:    4194304,
+				RssSet:     true,
+				Rss:        1572864,
+			},
+			want: map[*prometheus.Desc]testMetric{
+				libvirtDomainMemoryStatAvailableDesc:         {value: 0},
+				libvirtDomainMemoryStatActualBaloonBytesDesc: {value: 2 << 30},
+				libvirtDomainMemoryStatMaximumBytesDesc:      {value: 4 << 30},
+				libvirtDomainMemoryStatRssBytesDesc:          {value: 1.5 * (1 << 30)},
+			},
+		},
+		{
+			name: "guest stats",
+			balloon: &libvirt.DomainStatsBalloon{
+				CurrentSet:    true,
+				Current:       4194304,
+				SwapInSet:     true,
+				SwapIn:        16,
+				SwapOutSet:    true,
+				SwapOut:       32,
+				MajorFaultSet: true,
+				MajorFault:    100,
+				MinorFaultSet: true,
+				MinorFault:    200,
+				UnusedSet:     true,
+				Unused:        524288,
+				AvailableSet:  true,
+				Available:     4194304,
+				UsableSet:     true,
+				Usable:        1048576,
+				LastUpdateSet: true,
+				LastUpdate:    1600000000,
+				DiskCachesSet: true,
+				DiskCaches:    262144,
+				// Not reported by the guest
+				HugetlbPgAlloc: 5,
+				HugetlbPgFail:  1,
+			},
+			want: map[*prometheus.Desc]testMetric{
+				libvirtDomainMemoryStatAvailableDesc:         {value: 1},
+				libvirtDomainMemoryStatActualBaloonBytesDesc: {value: 4 << 30},
+				libvirtDomainMemoryStatSwapInBytesDesc:       {value: 16 << 10, counter: true},
+				libvirtDomainMemoryStatSwapOutBytesDesc:      {value: 32 << 10, counter: true},
+				libvirtDomainMemoryStatMajorFaultTotalDesc:   {value: 100, counter: true},
+				libvirtDomainMemoryStatMinorFaultTotalDesc:   {value: 200, counter: true},
+				libvirtDomainMemoryStatUnusedBytesDesc:       {value: 512 << 20},
+				libvirtDomainMemoryStatAvailableBytesDesc:    {value: 4 << 30},
+				libvirtDomainMemoryStatUsableBytesDesc:       {value: 1 << 30},
+				libvirtDomainMemoryStatLastUpdateDesc:        {value: 1600000000},
+				libvirtDomainMemoryStatDiskCachesBytesDesc:   {value: 256 << 20},
+				libvirtDomainMemoryStatUsedPercentDesc:       {value: 75},
+			},
+		},
+		{
+			name: "zero available memory",
+			balloon: &libvirt.DomainStatsBalloon{
+				AvailableSet: true,
+				UsableSet:    true,
+			},
+			want: map[*prometheus.Desc]testMetric{
+				libvirtDomainMemoryStatAvailableDesc:      {value: 1},
+				libvirtDomainMemoryStatAvailableBytesDesc: {value: 0},
+				libvirtDomainMemoryStatUsableBytesDesc:    {value: 0},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			domain := testDomainContext(libvirt.DomainStats{Balloon: test.balloon})
+			checkTestMetrics(t, collectTestMetrics(t, collectDomainMemory, domain), test.want)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"libvirt.org/go/libvirt"
+)
+
+// MemoryStatsPeriodConfig enables setting the balloon stats period of
+// running domains. The guest memory statistics are not refreshed unless the
+// period is set.
+type MemoryStatsPeriodConfig struct {
+	// Period is set on the domains having another period, in whole
+	// seconds. Zero disables the change.
+	Period time.Duration `yaml:"period"`
+	// DryRun only reports the domains that would be changed.
+	DryRun bool `yaml:"dry_run"`
+}
+
+func (c MemoryStatsPeriodConfig) validate() error {
+	if c.Period < 0 || c.Period%time.Second != 0 {
+		return fmt.Errorf("memory stats period must be a non-negative number of seconds, got %s", c.Period)
+	}
+	return nil
+}
+
+// collectMemoryStatsPeriod reports the balloon stats period of an active
+// domain and sets it to the configured one if the domain is running. The
+// period is changed on the live domain only, its persistent configuration
+// is left as is. Domains are not changed in dry-run mode or while their
+// stats are incomplete.
+func collectMemoryStatsPeriod(ch chan<- prometheus.Metric, domain *DomainContext) {
+	balloon := domain.Desc.Devices.MemBalloon
+	if balloon.Model == "" || balloon.Model == "none" || domain.Stat.State == nil {
+		return
+	}
+	state := domain.Stat.State.State
+	if state == libvirt.DOMAIN_SHUTOFF || state == libvirt.DOMAIN_NOSTATE {
+		// The period in the XML of an inactive domain is not in effect
+		return
+	}
+
+	period := balloon.Stats.Period
+	target := int(domain.MemoryStatsPeriod.Period / time.Second)
+	if target > 0 {
+		// Only a running domain is sure to have a working balloon driver
+		pending := period != target && state == libvirt.DOMAIN_RUNNING
+		// In dry-run mode the pending change is only reported by the
+		// metric. The domain is not changed while a job holds it, e.g. a
+		// migration, it is retried on the next scrape.
+		if pending && !domain.MemoryStatsPeriod.DryRun && !domain.Incomplete {
+			start := time.Now()
+			err := domain.Stat.Domain.SetMemoryStatsPeriod(target, libvirt.DOMAIN_MEM_LIVE)
+			domain.ScrapeStats.ObserveCall("virDomainSetMemoryStatsPeriod", start)
+			if err != nil {
+				domain.ScrapeStats.ObserveDomainError(&DomainError{Domain: domain.Name, Stage: "memory_stats_period", Err: err})
+			} else {
+				period = target
+				pending = false
+			}
+		}
+		var pendingValue float64
+		if pending {
+			pendingValue = 1
+		}
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainMemoryStatPeriodChangePendingDesc,
+			prometheus.GaugeValue,
+			pendingValue,
+			domain.Name)
+	}
+
+	ch <- domain.MustNewConstMetric(
+		libvirtDomainMemoryStatPeriodDesc,
+		prometheus.GaugeValue,
+		float64(period),
+		domain.Name)
+}
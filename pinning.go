@@ -0,0 +1,167 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"libvirt.org/go/libvirt"
+)
+
+// formatCPUSet formats a CPU map the way libvirt does, e.g. "0-3,8".
+func formatCPUSet(cpumap []bool) string {
+	var ranges []string
+	for cpu := 0; cpu < len(cpumap); cpu++ {
+		if !cpumap[cpu] {
+			continue
+		}
+		first := cpu
+		for cpu+1 < len(cpumap) && cpumap[cpu+1] {
+			cpu++
+		}
+		if first == cpu {
+			ranges = append(ranges, strconv.Itoa(cpu))
+		} else {
+			ranges = append(ranges, strconv.Itoa(first)+"-"+strconv.Itoa(cpu))
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+// cpuMapPinned tells whether a CPU map excludes some of the host CPUs.
+func cpuMapPinned(cpumap []bool) bool {
+	for _, allowed := range cpumap {
+		if !allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedError tells whether err means that the driver does not
+// support the call or that the domain does not allow it, e.g. vCPU pinning
+// of an LXC domain.
+func unsupportedError(err error) bool {
+	lverr, ok := err.(libvirt.Error)
+	return ok && (lverr.Code == libvirt.ERR_NO_SUPPORT || lverr.Code == libvirt.ERR_OPERATION_INVALID)
+}
+
+// collectDomainPinning reports the host CPUs allowed to run the vCPUs and
+// the emulator threads of an active domain. Pinned vCPUs are accounted in
+// scrapeStats for libvirt_host_cpu_pinned_vcpus. Pinning the driver does
+// not support is not reported.
+func collectDomainPinning(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	if domain.Stat.State == nil || domain.Stat.State.State == libvirt.DOMAIN_SHUTOFF {
+		// Pinning of an inactive domain does not affect the host
+		return nil
+	}
+
+	start := time.Now()
+	vcpus, err := domain.Stat.Domain.GetVcpuPinInfo(libvirt.DOMAIN_AFFECT_LIVE)
+	domain.ScrapeStats.ObserveCall("virDomainGetVcpuPinInfo", start)
+	if err != nil && !unsupportedError(err) {
+		return err
+	}
+	for vcpu, cpumap := range vcpus {
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainVcpuPinningInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domain.Name,
+			strconv.Itoa(vcpu),
+			formatCPUSet(cpumap))
+		if cpuMapPinned(cpumap) {
+			domain.ScrapeStats.ObservePinnedVcpu(cpumap)
+		}
+	}
+
+	start = time.Now()
+	cpumap, err := domain.Stat.Domain.GetEmulatorPinInfo(libvirt.DOMAIN_AFFECT_LIVE)
+	domain.ScrapeStats.ObserveCall("virDomainGetEmulatorPinInfo", start)
+	if err != nil {
+		if unsupportedError(err) {
+			return nil
+		}
+		return err
+	}
+	ch <- domain.MustNewConstMetric(
+		libvirtDomainEmulatorPinningInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		domain.Name,
+		formatCPUSet(cpumap))
+
+	return nil
+}
+
+// collectHostCPUPinning reports the number of vCPUs pinned to every host
+// CPU by the domains collected in the scrape.
+func collectHostCPUPinning(ch chan<- prometheus.Metric, conn *libvirt.Connect, scrapeStats *ScrapeStats) error {
+	start := time.Now()
+	cpumap, _, err := conn.GetCPUMap(0)
+	scrapeStats.ObserveCall("virNodeGetCPUMap", start)
+	if err != nil {
+		return err
+	}
+	// Same CPUs as in the CPU maps of the domains, offline ones included.
+	// The topology of virNodeGetInfo is approximate on some NUMA hosts.
+	cpus := len(cpumap)
+	pinned := scrapeStats.PinnedVcpus()
+	for cpu := 0; cpu < cpus; cpu++ {
+		ch <- prometheus.MustNewConstMetric(
+			libvirtHostCPUPinnedVcpusDesc,
+			prometheus.GaugeValue,
+			float64(pinned[cpu]),
+			strconv.Itoa(cpu))
+	}
+	return nil
+}
+
+// collectDomainIOThreads reports the host CPUs allowed to run the IOThreads
+// of an active domain. Polling parameters of the IOThreads are not
+// reported, as the libvirt binding in use does not parse them from the
+// domain stats.
+func collectDomainIOThreads(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	if domain.Stat.State == nil || domain.Stat.State.State == libvirt.DOMAIN_SHUTOFF {
+		return nil
+	}
+	if domain.Incomplete {
+		// GetIOThreadInfo would wait for the domain job
+		return nil
+	}
+
+	start := time.Now()
+	iothreads, err := domain.Stat.Domain.GetIOThreadInfo(libvirt.DOMAIN_AFFECT_LIVE)
+	domain.ScrapeStats.ObserveCall("virDomainGetIOThreadInfo", start)
+	if err != nil {
+		lverr, ok := err.(libvirt.Error)
+		if ok && lverr.Code == libvirt.ERR_NO_SUPPORT {
+			// The hypervisor has no IOThreads
+			return nil
+		}
+		return err
+	}
+	for _, iothread := range iothreads {
+		ch <- domain.MustNewConstMetric(
+			libvirtDomainIOThreadPinningInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			domain.Name,
+			strconv.FormatUint(uint64(iothread.IOThreadID), 10),
+			formatCPUSet(iothread.CpuMap))
+	}
+	return nil
+}
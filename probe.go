@@ -0,0 +1,104 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ProbeModule describes how a probed target is collected.
+type ProbeModule struct {
+	// Collectors lists names of the enabled collectors.
+	Collectors []string `yaml:"collectors"`
+}
+
+// ProbeConfig lists the URIs that may be probed and the modules used to
+// probe them. The default module uses the collectors enabled for the
+// exporter unless it is defined.
+type ProbeConfig struct {
+	AllowedTargets []string               `yaml:"allowed_targets"`
+	Modules        map[string]ProbeModule `yaml:"modules"`
+}
+
+// ProbeHandler serves metrics of the libvirt URI given in the target
+// parameter of a request, the way blackbox_exporter does. Only URIs listed
+// in allowedTargets may be probed. The module parameter selects one of
+// modules, "default" is used if it is omitted.
+type ProbeHandler struct {
+	allowedTargets map[string]struct{}
+	modules        map[string]ProbeModule
+	opts           ExporterOptions
+}
+
+// NewProbeHandler creates a probe handler. Options other than the
+// collectors, which are defined per module, are shared by all probes.
+func NewProbeHandler(allowedTargets []string, modules map[string]ProbeModule, opts ExporterOptions) (*ProbeHandler, error) {
+	h := &ProbeHandler{
+		allowedTargets: make(map[string]struct{}),
+		modules:        modules,
+		opts:           opts,
+	}
+	for _, target := range allowedTargets {
+		h.allowedTargets[target] = struct{}{}
+	}
+	for name, module := range modules {
+		if _, err := LookupCollectors(module.Collectors); err != nil {
+			return nil, fmt.Errorf("probe module %s: %s", name, err)
+		}
+	}
+	// Probes are short-lived, there is nothing to poll
+	h.opts.PollInterval = 0
+	// Probing a target must not change its domains
+	h.opts.MemoryStatsPeriod = MemoryStatsPeriodConfig{}
+	return h, nil
+}
+
+func (h *ProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.allowedTargets[target]; !ok {
+		http.Error(w, fmt.Sprintf("Target %q is not allowed", target), http.StatusForbidden)
+		return
+	}
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+	module, ok := h.modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	opts := h.opts
+	opts.Collectors = module.Collectors
+	exporter, err := NewLibvirtExporter(target, opts)
+	if err != nil {
+		log.Printf("Failed to create exporter for %s: %s", target, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer exporter.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&scrapeCollector{exporter: exporter, timeout: exporter.scrapeTimeout(r)})
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,211 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "libvirt_exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "libvirt_exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+// ExporterSet holds exporters of the configured connections along with the
+// probe handler and replaces them when the configuration is reloaded.
+type ExporterSet struct {
+	filename string
+	base     Config
+	opts     ExporterOptions
+
+	reloadMu  sync.Mutex // serializes reloads
+	mu        sync.Mutex
+	labelName string
+	exporters map[string]*LibvirtExporter
+	probe     *ProbeHandler
+}
+
+// NewExporterSet loads the configuration file over base and creates the
+// exporters. Options set by arguments only, e.g. the concurrency, are
+// shared by all exporters and are not reloaded.
+func NewExporterSet(filename string, base Config, opts ExporterOptions) (*ExporterSet, error) {
+	s := &ExporterSet{
+		filename: filename,
+		base:     base,
+		opts:     opts,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the configuration file again and applies it. Exporters of
+// unchanged connections are kept along with their libvirt connections. If
+// the configuration is invalid, the current one stays in effect.
+func (s *ExporterSet) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if err := s.reload(); err != nil {
+		configLastReloadSuccessful.Set(0)
+		return err
+	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (s *ExporterSet) reload() error {
+	cfg, err := LoadConfig(s.filename, s.base)
+	if err != nil {
+		return err
+	}
+	opts := s.opts
+	opts.Collectors = cfg.EnabledCollectors()
+	opts.DomainFilter = cfg.DomainFilter
+	opts.DomainLabels = cfg.DomainLabels
+	opts.CustomLabels = cfg.CustomLabels
+	opts.BlockDeviceTypes = cfg.BlockDeviceTypes
+	opts.MemoryStatsPeriod = cfg.MemoryStatsPeriod
+	opts.CPUUtilisation = cfg.CPUUtilisation
+	modules := map[string]ProbeModule{
+		"default": {Collectors: opts.Collectors},
+	}
+	for name, module := range cfg.Probe.Modules {
+		modules[name] = module
+	}
+	probe, err := NewProbeHandler(cfg.Probe.AllowedTargets, modules, opts)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	current := s.exporters
+	s.mu.Unlock()
+
+	exporters := make(map[string]*LibvirtExporter)
+	var created []*LibvirtExporter
+	for _, conn := range cfg.Connections {
+		if e, ok := current[conn.Name]; ok && e.conn.uri == conn.URI && reflect.DeepEqual(e.opts, opts) {
+			exporters[conn.Name] = e
+			continue
+		}
+		e, err := NewLibvirtExporter(conn.URI, opts)
+		if err != nil {
+			for _, e := range created {
+				e.Close()
+			}
+			return err
+		}
+		created = append(created, e)
+		exporters[conn.Name] = e
+	}
+
+	s.mu.Lock()
+	s.labelName = cfg.ConnectionLabel
+	s.exporters = exporters
+	s.probe = probe
+	s.mu.Unlock()
+
+	for name, e := range current {
+		if exporters[name] != e {
+			e.Close()
+		}
+	}
+	return nil
+}
+
+// MetricsHandler returns an HTTP handler exposing metrics of the exporters
+// along with those of the default registry. Exporters are collected in
+// parallel, each scrape is limited by the timeout requested by Prometheus.
+// If there are several exporters, the connection label is added to their
+// metrics, so that series do not collide.
+func (s *ExporterSet) MetricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		labelName, exporters := s.labelName, s.exporters
+		s.mu.Unlock()
+
+		registry := prometheus.NewRegistry()
+		for name, e := range exporters {
+			var registerer prometheus.Registerer = registry
+			if len(exporters) > 1 {
+				registerer = prometheus.WrapRegistererWith(prometheus.Labels{labelName: name}, registry)
+			}
+			if err := registerer.Register(&scrapeCollector{exporter: e, timeout: e.scrapeTimeout(r)}); err != nil {
+				log.Printf("Failed to register exporter of %s: %s", name, err)
+				http.Error(w, "Failed to register exporter of "+name+": "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}))
+}
+
+// checkConnectionLabel reports an error if the connection label cannot be
+// added to the metrics of an exporter with the given policy, i.e. if any of
+// them, whichever collectors are enabled, has a label of the same name.
+func checkConnectionLabel(name string, policy *DomainPolicy) error {
+	exporter := &LibvirtExporter{collectors: collectors, policy: policy}
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{name: ""}, prometheus.NewRegistry())
+	if err := registerer.Register(&scrapeCollector{exporter: exporter}); err != nil {
+		return fmt.Errorf("connection label %q conflicts with a metric label: %s", name, err)
+	}
+	return nil
+}
+
+// ProbeHandler returns an HTTP handler serving probes with the current
+// configuration.
+func (s *ExporterSet) ProbeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		probe := s.probe
+		s.mu.Unlock()
+		probe.ServeHTTP(w, r)
+	})
+}
+
+// ReloadHandler returns an HTTP handler reloading the configuration on a
+// POST request.
+func (s *ExporterSet) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Failed to reload configuration: %s", err)
+			http.Error(w, "Failed to reload configuration: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Configuration reloaded")
+	})
+}
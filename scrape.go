@@ -0,0 +1,275 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrape holds the metrics of a single collection from libvirt. It may be
+// shared by several concurrent HTTP requests and, in polling mode, served
+// repeatedly until the next scrape has finished.
+type scrape struct {
+	done chan struct{}
+
+	mu       sync.Mutex
+	metrics  []prometheus.Metric
+	err      error
+	finished time.Time
+}
+
+// startScrape runs collect in background and returns the scrape it fills.
+func startScrape(collect func(ch chan<- prometheus.Metric) error) *scrape {
+	s := &scrape{
+		done: make(chan struct{}),
+	}
+	metrics := make(chan prometheus.Metric)
+	collected := make(chan struct{})
+	go func() {
+		for metric := range metrics {
+			s.mu.Lock()
+			s.metrics = append(s.metrics, metric)
+			s.mu.Unlock()
+		}
+		close(collected)
+	}()
+	go func() {
+		err := collect(metrics)
+		close(metrics)
+		<-collected
+
+		s.mu.Lock()
+		s.err = err
+		s.finished = time.Now()
+		s.mu.Unlock()
+		close(s.done)
+	}()
+	return s
+}
+
+// Finished reports whether the scrape is over.
+func (s *scrape) Finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait waits for the scrape to finish and returns its metrics. If it takes
+// longer than timeout (unless timeout is zero), Wait returns the metrics
+// collected so far along with an error. Libvirt calls cannot be
+// interrupted, so the scrape itself keeps running in background.
+func (s *scrape) Wait(timeout time.Duration) ([]prometheus.Metric, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case <-s.done:
+	case <-deadline:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.metrics[:len(s.metrics):len(s.metrics)], fmt.Errorf("scrape timed out after %s", timeout)
+	}
+	return s.metrics, s.err
+}
+
+// Age returns time passed since the scrape has finished.
+func (s *scrape) Age() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished.IsZero() {
+		return 0
+	}
+	return time.Since(s.finished)
+}
+
+var (
+	libvirtScrapeCollectorDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "scrape_collector", "duration_seconds"),
+		"Time spent by the collector during the last scrape, summed over all domains.",
+		[]string{"collector"},
+		nil)
+	libvirtScrapeCollectorSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "scrape_collector", "success"),
+		"Whether the collector has succeeded for all domains during the last scrape.",
+		[]string{"collector"},
+		nil)
+	libvirtScrapeCallsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "scrape", "calls"),
+		"Number of libvirt API calls made during the last scrape.",
+		[]string{"call"},
+		nil)
+	libvirtScrapeCallsDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("libvirt", "scrape", "calls_duration_seconds"),
+		"Time spent in libvirt API calls during the last scrape.",
+		[]string{"call"},
+		nil)
+)
+
+type collectorStats struct {
+	duration time.Duration
+	failed   bool
+}
+
+type callStats struct {
+	count    int
+	duration time.Duration
+}
+
+// ScrapeStats accounts the time spent by collectors and libvirt API calls
+// during a single scrape, along with the data of domains reported for the
+// whole host. It is safe for concurrent use.
+type ScrapeStats struct {
+	mu         sync.Mutex
+	collectors map[string]*collectorStats
+	calls      map[string]*callStats
+	filtered   int
+	// domainErrors are errors that have not prevented the domain from
+	// being reported
+	domainErrors []*DomainError
+	// pinnedVcpus maps host CPUs to the number of vCPUs pinned to them
+	pinnedVcpus map[int]int
+}
+
+// NewScrapeStats creates empty scrape stats.
+func NewScrapeStats() *ScrapeStats {
+	return &ScrapeStats{
+		collectors:  make(map[string]*collectorStats),
+		calls:       make(map[string]*callStats),
+		pinnedVcpus: make(map[int]int),
+	}
+}
+
+// ObserveCollector accounts a run of the collector started at start.
+func (s *ScrapeStats) ObserveCollector(name string, start time.Time, err error) {
+	duration := time.Since(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.collectors[name]
+	if !ok {
+		stats = &collectorStats{}
+		s.collectors[name] = stats
+	}
+	stats.duration += duration
+	stats.failed = stats.failed || err != nil
+}
+
+// ObserveCall accounts a libvirt API call started at start.
+func (s *ScrapeStats) ObserveCall(name string, start time.Time) {
+	duration := time.Since(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.calls[name]
+	if !ok {
+		stats = &callStats{}
+		s.calls[name] = stats
+	}
+	stats.count++
+	stats.duration += duration
+}
+
+// ObserveFiltered accounts a domain skipped by the domain filter.
+func (s *ScrapeStats) ObserveFiltered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filtered++
+}
+
+// Filtered returns the number of domains skipped by the domain filter.
+func (s *ScrapeStats) Filtered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filtered
+}
+
+// ObserveDomainError accounts an error that has not prevented the domain
+// from being reported.
+func (s *ScrapeStats) ObserveDomainError(err *DomainError) {
+	log.Printf("Failed to scrape domain metrics: %s", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domainErrors = append(s.domainErrors, err)
+}
+
+// DomainErrors returns the errors passed to ObserveDomainError.
+func (s *ScrapeStats) DomainErrors() []*DomainError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.domainErrors
+}
+
+// ObservePinnedVcpu accounts a vCPU pinned to the host CPUs set in cpumap.
+func (s *ScrapeStats) ObservePinnedVcpu(cpumap []bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cpu, allowed := range cpumap {
+		if allowed {
+			s.pinnedVcpus[cpu]++
+		}
+	}
+}
+
+// PinnedVcpus returns the number of vCPUs pinned to every host CPU.
+func (s *ScrapeStats) PinnedVcpus() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pinned := make(map[int]int, len(s.pinnedVcpus))
+	for cpu, count := range s.pinnedVcpus {
+		pinned[cpu] = count
+	}
+	return pinned
+}
+
+// Collect reports the scrape stats.
+func (s *ScrapeStats) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, stats := range s.collectors {
+		var success float64
+		if !stats.failed {
+			success = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			libvirtScrapeCollectorDurationDesc,
+			prometheus.GaugeValue,
+			stats.duration.Seconds(),
+			name)
+		ch <- prometheus.MustNewConstMetric(
+			libvirtScrapeCollectorSuccessDesc,
+			prometheus.GaugeValue,
+			success,
+			name)
+	}
+	for name, stats := range s.calls {
+		ch <- prometheus.MustNewConstMetric(
+			libvirtScrapeCallsDesc,
+			prometheus.GaugeValue,
+			float64(stats.count),
+			name)
+		ch <- prometheus.MustNewConstMetric(
+			libvirtScrapeCallsDurationDesc,
+			prometheus.GaugeValue,
+			stats.duration.Seconds(),
+			name)
+	}
+}
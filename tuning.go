@@ -0,0 +1,114 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"libvirt.org/go/libvirt"
+)
+
+// cpuQuotaMax is the quota libvirt reports for an unlimited cgroup v2
+// bandwidth.
+const cpuQuotaMax = 17592186044415
+
+// cpuQuotaSet tells whether a CPU quota limits the bandwidth. Negative
+// quotas and cpuQuotaMax mean no limit.
+func cpuQuotaSet(set bool, quota int64) bool {
+	return set && quota > 0 && quota < cpuQuotaMax
+}
+
+// collectDomainScheduler reports the CPU scheduler parameters of an active
+// domain set by cputune. Quotas are reported only if they limit the
+// bandwidth. Nothing is reported if the driver does not support them.
+func collectDomainScheduler(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	if domain.Stat.State == nil || domain.Stat.State.State == libvirt.DOMAIN_SHUTOFF {
+		// Parameters of an inactive domain are not in effect
+		return nil
+	}
+
+	start := time.Now()
+	params, err := domain.Stat.Domain.GetSchedulerParametersFlags(libvirt.DOMAIN_AFFECT_LIVE)
+	domain.ScrapeStats.ObserveCall("virDomainGetSchedulerParametersFlags", start)
+	if err != nil {
+		if unsupportedError(err) {
+			// No scheduler parameters, e.g. without the cpu cgroup
+			return nil
+		}
+		return err
+	}
+	for _, param := range []struct {
+		set   bool
+		value float64
+		desc  *prometheus.Desc
+	}{
+		{params.CpuSharesSet, float64(params.CpuShares), libvirtDomainSchedulerCPUSharesDesc},
+		// Periods and quotas are in microseconds
+		{params.GlobalPeriodSet, float64(params.GlobalPeriod) / 1e6, libvirtDomainSchedulerGlobalPeriodDesc},
+		{cpuQuotaSet(params.GlobalQuotaSet, params.GlobalQuota), float64(params.GlobalQuota) / 1e6, libvirtDomainSchedulerGlobalQuotaDesc},
+		{params.VcpuPeriodSet, float64(params.VcpuPeriod) / 1e6, libvirtDomainSchedulerVcpuPeriodDesc},
+		{cpuQuotaSet(params.VcpuQuotaSet, params.VcpuQuota), float64(params.VcpuQuota) / 1e6, libvirtDomainSchedulerVcpuQuotaDesc},
+		{params.EmulatorPeriodSet, float64(params.EmulatorPeriod) / 1e6, libvirtDomainSchedulerEmulatorPeriodDesc},
+		{cpuQuotaSet(params.EmulatorQuotaSet, params.EmulatorQuota), float64(params.EmulatorQuota) / 1e6, libvirtDomainSchedulerEmulatorQuotaDesc},
+		{params.IothreadPeriodSet, float64(params.IothreadPeriod) / 1e6, libvirtDomainSchedulerIOThreadPeriodDesc},
+		{cpuQuotaSet(params.IothreadQuotaSet, params.IothreadQuota), float64(params.IothreadQuota) / 1e6, libvirtDomainSchedulerIOThreadQuotaDesc},
+	} {
+		if param.set {
+			ch <- domain.MustNewConstMetric(param.desc, prometheus.GaugeValue, param.value, domain.Name)
+		}
+	}
+	return nil
+}
+
+// memoryLimitSet tells whether a memtune limit is set to a value other than
+// unlimited.
+func memoryLimitSet(set bool, limit uint64) bool {
+	return set && limit != uint64(libvirt.DOMAIN_MEMORY_PARAM_UNLIMITED)
+}
+
+// collectDomainMemtune reports the memory limits of an active domain set
+// by memtune. Unlimited values are not reported, nor anything if the driver
+// does not support the limits.
+func collectDomainMemtune(ch chan<- prometheus.Metric, domain *DomainContext) error {
+	if domain.Stat.State == nil || domain.Stat.State.State == libvirt.DOMAIN_SHUTOFF {
+		// Limits of an inactive domain are not in effect
+		return nil
+	}
+
+	start := time.Now()
+	params, err := domain.Stat.Domain.GetMemoryParameters(libvirt.DOMAIN_AFFECT_LIVE)
+	domain.ScrapeStats.ObserveCall("virDomainGetMemoryParameters", start)
+	if err != nil {
+		if unsupportedError(err) {
+			// No memory limits, e.g. without the memory cgroup
+			return nil
+		}
+		return err
+	}
+	for _, param := range []struct {
+		set   bool
+		value uint64 // KiB
+		desc  *prometheus.Desc
+	}{
+		{params.HardLimitSet, params.HardLimit, libvirtDomainMemtuneHardLimitDesc},
+		{params.SoftLimitSet, params.SoftLimit, libvirtDomainMemtuneSoftLimitDesc},
+		{params.SwapHardLimitSet, params.SwapHardLimit, libvirtDomainMemtuneSwapHardLimitDesc},
+		{params.MinGuaranteeSet, params.MinGuarantee, libvirtDomainMemtuneMinGuaranteeDesc},
+	} {
+		if memoryLimitSet(param.set, param.value) {
+			ch <- domain.MustNewConstMetric(param.desc, prometheus.GaugeValue, float64(param.value)*1024, domain.Name)
+		}
+	}
+	return nil
+}